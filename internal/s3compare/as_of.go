@@ -0,0 +1,145 @@
+package s3compare
+
+import (
+	"context"
+	"time"
+)
+
+// asOfFilter selects, from a version listing (each key's versions newest first), the versions that existed at a point
+// in time. It is fed every listed version in order, across pages.
+type asOfFilter struct {
+	asOf time.Time
+
+	// history keeps every version created at or before asOf rather than just the one current at that time.
+	history bool
+
+	// resolvedKey is the last key whose current version has been determined; its older versions are skipped.
+	resolvedKey string
+	resolved    bool
+}
+
+// include indicates whether obj should be included in the listing. A key whose current version at asOf is a delete
+// marker is omitted unless the whole history is being kept.
+func (aof *asOfFilter) include(obj *ListedObject) bool {
+	if obj.LastModified.After(aof.asOf) {
+		return false
+	}
+
+	if aof.history {
+		return true
+	}
+
+	if aof.resolved && obj.Key == aof.resolvedKey {
+		return false
+	}
+
+	aof.resolvedKey = obj.Key
+	aof.resolved = true
+
+	return !obj.IsDeleteMarker
+}
+
+// asOfListPaginator lists the children of a prefix as they were at a point in time, using a version listing.
+type asOfListPaginator struct {
+	backend   VersionBackend
+	paginator ListPaginator
+	filter    asOfFilter
+
+	// call makes each request for a page, both of the listing and of the additional listings made by prefixVisible.
+	call func(fn func() error) error
+
+	// pending is a page read from paginator that couldn't be filtered, which is retried by the next call to NextPage.
+	pending *ListPage
+}
+
+// newAsOfListPaginator returns a paginator over the children of prefix (or, if recursive is set, every key under
+// prefix) following startAfter at asOf. If history is set, every version up to that time is listed (as with
+// NewVersionListPaginator); otherwise, only the version current at that time. Each page is requested through call,
+// including those of the additional listings made to check whether subprefixes have any keys at asOf.
+func newAsOfListPaginator(backend VersionBackend, prefix string, recursive bool, startAfter string, asOf time.Time,
+	history bool, call func(fn func() error) error) *asOfListPaginator {
+	return &asOfListPaginator{
+		backend:   backend,
+		paginator: backend.NewVersionListPaginator(prefix, recursive, startAfter),
+		filter:    asOfFilter{asOf: asOf, history: history},
+		call:      call,
+	}
+}
+
+func (aolp *asOfListPaginator) HasMorePages() bool {
+	return aolp.pending != nil || aolp.paginator.HasMorePages()
+}
+
+// makesOwnCalls indicates that each request for a page is made through aolp.call.
+func (aolp *asOfListPaginator) makesOwnCalls() bool {
+	return true
+}
+
+func (aolp *asOfListPaginator) NextPage(ctx context.Context) (*ListPage, error) {
+	page := aolp.pending
+
+	if page == nil {
+		err := aolp.call(func() (err error) {
+			page, err = aolp.paginator.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &ListPage{
+		Subprefixes: make([]string, 0, len(page.Subprefixes)),
+		Objects:     make([]ListedObject, 0, len(page.Objects)),
+	}
+
+	// Subprefixes are listed if anything has ever been stored under them; only keep those with keys at asOf.
+	for _, subprefix := range page.Subprefixes {
+		visible, err := aolp.prefixVisible(ctx, subprefix)
+		if err != nil {
+			aolp.pending = page
+			return nil, err
+		}
+
+		if visible {
+			result.Subprefixes = append(result.Subprefixes, subprefix)
+		}
+	}
+
+	aolp.pending = nil
+
+	for i := range page.Objects {
+		if aolp.filter.include(&page.Objects[i]) {
+			result.Objects = append(result.Objects, page.Objects[i])
+		}
+	}
+
+	return result, nil
+}
+
+// prefixVisible indicates whether any key under prefix (at any depth) would be listed at the filter's point in time.
+// The search stops at the first such key.
+func (aolp *asOfListPaginator) prefixVisible(ctx context.Context, prefix string) (bool, error) {
+	paginator := aolp.backend.NewVersionListPaginator(prefix, true, "")
+	filter := asOfFilter{asOf: aolp.filter.asOf, history: aolp.filter.history}
+
+	for paginator.HasMorePages() {
+		var page *ListPage
+
+		err := aolp.call(func() (err error) {
+			page, err = paginator.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+
+		for i := range page.Objects {
+			if filter.include(&page.Objects[i]) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
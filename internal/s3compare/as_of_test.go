@@ -0,0 +1,94 @@
+package s3compare
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAsOfFilter(t *testing.T) {
+	t0 := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	hour := func(n int) time.Time { return t0.Add(time.Duration(n) * time.Hour) }
+
+	// Each key's versions, newest first, as a version listing returns them.
+	versions := []ListedObject{
+		{Key: "a", VersionID: "a3", LastModified: hour(3)},
+		{Key: "a", VersionID: "a2", LastModified: hour(2)},
+		{Key: "a", VersionID: "a1", LastModified: hour(1)},
+		{Key: "b", VersionID: "b2", LastModified: hour(2), IsDeleteMarker: true},
+		{Key: "b", VersionID: "b1", LastModified: hour(1)},
+		{Key: "c", VersionID: "c1", LastModified: hour(3)},
+		{Key: "d", VersionID: "d2", LastModified: hour(3), IsDeleteMarker: true},
+		{Key: "d", VersionID: "d1", LastModified: hour(1)},
+	}
+
+	tests := []struct {
+		history  bool
+		expected string
+	}{
+		{history: false, expected: "a2 d1"},
+		{history: true, expected: "a2 a1 b2 b1 d1"},
+	}
+
+	for _, test := range tests {
+		filter := asOfFilter{asOf: hour(2), history: test.history}
+
+		var included []string
+
+		for i := range versions {
+			if filter.include(&versions[i]) {
+				included = append(included, versions[i].VersionID)
+			}
+		}
+
+		if got := strings.Join(included, " "); got != test.expected {
+			t.Errorf("history=%v: got %#v; expected %#v", test.history, got, test.expected)
+		}
+	}
+}
+
+func TestCompareAsOf(t *testing.T) {
+	t0 := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := newMemoryBackend("bucket2")
+
+	backend1.put("a", "1", t0)
+	backend1.put("f/g", "8", t0)
+
+	// At t0+1h, a had its first version, d/ had been emptied, e/ didn't exist yet, and f/g differed.
+	backend2.put("a", "1", t0)
+	backend2.put("a", "2", t0.Add(2*time.Hour))
+	backend2.put("d/b", "1", t0)
+	backend2.remove("d/b", t0.Add(30*time.Minute))
+	backend2.put("e/c", "1", t0.Add(2*time.Hour))
+	backend2.put("f/g", "9", t0)
+	backend2.put("f/g", "8", t0.Add(2*time.Hour))
+
+	for _, flat := range []bool{false, true} {
+		output := &bytes.Buffer{}
+		s3c := NewS3Comparer(context.Background(), output, OutputFormatJSON, backend1, backend2)
+
+		if err := s3c.AsOf2(t0.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		if flat {
+			s3c.FlatListing()
+		}
+
+		summary := s3c.ComparePrefixes("", "")
+		reports := decodeReports(t, output.Bytes())
+
+		if summary.Compared != 2 || len(reports) != 1 {
+			t.Fatalf("flat=%v: expected two keys compared and one report; got %+v:\n%s", flat, summary, output)
+		}
+
+		// The version current at the time is reported.
+		if dr := reports[0]; dr.Type != DiffTypeMismatch || dr.Objects[SecondObject].URL != "mem://bucket2/f/g" ||
+			dr.Objects[SecondObject].VersionID != "v1" {
+			t.Errorf("flat=%v: expected a mismatch with the first version of f/g; got %+v", flat, dr)
+		}
+	}
+}
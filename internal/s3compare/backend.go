@@ -0,0 +1,129 @@
+package s3compare
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Backend is a storage system holding a tree of objects to compare. Keys are slash-separated paths; prefixes ending
+// in "/" act as directories.
+type Backend interface {
+	// URL returns the URL of the given key (or prefix), for display.
+	URL(key string) string
+
+	// NewListPaginator returns a paginator over the immediate children of prefix. Keys are grouped into subprefixes at
+	// the first "/" following prefix, as with an S3 listing using "/" as the delimiter. If recursive is set, every key
+	// under prefix is listed instead, with no subprefixes, as with an S3 listing without a delimiter. Either way, pages
+	// are returned in lexicographic key order. If startAfter is not empty, only keys and subprefixes following it are
+	// listed.
+	NewListPaginator(prefix string, recursive bool, startAfter string) ListPaginator
+
+	// StatObject returns the comparable attributes of the object at key. If versionID is not empty, that version of
+	// the object is examined instead of the current one. (Version IDs only come from listings, so backends without
+	// versions may ignore it.)
+	StatObject(ctx context.Context, key, versionID string) (*ObjectInfo, error)
+}
+
+// ContentBackend is implemented by backends that can read object contents.
+type ContentBackend interface {
+	Backend
+
+	// OpenObject returns a reader over the contents of the object (or version, if versionID is not empty) at key. The
+	// caller must close it.
+	OpenObject(ctx context.Context, key, versionID string) (io.ReadCloser, error)
+}
+
+// ChecksumBackend is implemented by backends that can report full-object checksums. Checksums have a cost (extra
+// permissions on S3, reading the whole file locally), so they are only reported once enabled.
+type ChecksumBackend interface {
+	Backend
+
+	// EnableChecksums causes subsequent calls to StatObject to populate ObjectInfo.Checksums.
+	EnableChecksums()
+}
+
+// PartBackend is implemented by backends that can describe how an object was uploaded in multiple parts.
+type PartBackend interface {
+	Backend
+
+	// PartLayout returns the size of each part (except possibly the last, which may be smaller) and the number of
+	// parts of the object (or version) at key. If the object was not uploaded in multiple parts, partCount is 0.
+	PartLayout(ctx context.Context, key, versionID string) (partSize int64, partCount int, err error)
+}
+
+// TagBackend is implemented by backends that can report object tags.
+type TagBackend interface {
+	Backend
+
+	// ObjectTags returns the tags of the object (or version) at key.
+	ObjectTags(ctx context.Context, key, versionID string) (map[string]string, error)
+}
+
+// ACLBackend is implemented by backends that can report object ACLs.
+type ACLBackend interface {
+	Backend
+
+	// ObjectACL returns the owner and access grants of the object (or version) at key.
+	ObjectACL(ctx context.Context, key, versionID string) (*ObjectACL, error)
+}
+
+// ObjectACL is the owner and access grants of an object. The owner is a canonical user ID.
+type ObjectACL struct {
+	Owner  string
+	Grants []ACLGrant
+}
+
+// ACLGrant grants a permission (READ, WRITE, READ_ACP, WRITE_ACP, or FULL_CONTROL) to a grantee. The grantee type is
+// named as in S3 grant headers: "id" (canonical user ID), "uri" (group), or "emailAddress".
+type ACLGrant struct {
+	GranteeType string
+	Grantee     string
+	Permission  string
+}
+
+// VersionBackend is implemented by backends that keep the version history of objects.
+type VersionBackend interface {
+	Backend
+
+	// NewVersionListPaginator returns a paginator over the children of prefix, as with NewListPaginator, but including
+	// every version and delete marker of each key.
+	NewVersionListPaginator(prefix string, recursive bool, startAfter string) ListPaginator
+}
+
+// ListPaginator iterates over the pages of a listing.
+type ListPaginator interface {
+	HasMorePages() bool
+	NextPage(ctx context.Context) (*ListPage, error)
+}
+
+// ListPage is one page of results from a ListPaginator. Subprefixes and object keys are full paths (including the
+// prefix being listed).
+type ListPage struct {
+	Subprefixes []string
+	Objects     []ListedObject
+}
+
+// ListedObject is an object returned by a listing. When listing versions, it is a single version or delete marker;
+// versions of a key are listed from newest to oldest. ETag and StorageClass are empty if the backend doesn't report
+// them in listings.
+type ListedObject struct {
+	Key            string
+	VersionID      string
+	IsDeleteMarker bool
+	Size           int64
+	ETag           string
+	StorageClass   string
+	LastModified   time.Time
+}
+
+// ObjectInfo holds the comparable attributes of an object. Headers are keyed by lowercase HTTP header name.
+//
+// Checksums are keyed by lowercase algorithm name (crc32, crc32c, sha1, sha256) and hold base64-encoded values as S3
+// reports them. Checksums of objects uploaded in multiple parts are checksums of the part checksums, and end in "-N"
+// where N is the number of parts.
+type ObjectInfo struct {
+	LastModified time.Time
+	Headers      map[string]string
+	Checksums    map[string]string
+}
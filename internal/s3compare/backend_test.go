@@ -0,0 +1,75 @@
+package s3compare
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackendCapabilities(t *testing.T) {
+	// Options that need more than the Backend interface fail unless both backends support them.
+	options := map[string]func(s3c *S3Comparer) error{
+		"CompareTags":     (*S3Comparer).CompareTags,
+		"CompareACLs":     (*S3Comparer).CompareACLs,
+		"CompareVersions": (*S3Comparer).CompareVersions,
+		"AsOf1":           func(s3c *S3Comparer) error { return s3c.AsOf1(time.Now()) },
+		"AsOf2":           func(s3c *S3Comparer) error { return s3c.AsOf2(time.Now()) },
+	}
+
+	root := t.TempDir()
+
+	for name, option := range options {
+		s3c := NewS3Comparer(context.Background(), &bytes.Buffer{}, OutputFormatText, newMemoryBackend("bucket1"),
+			newMemoryBackend("bucket2"))
+		if err := option(s3c); err != nil {
+			t.Errorf("%s with memory backends: unexpected error %v", name, err)
+		}
+
+		s3c = NewS3Comparer(context.Background(), &bytes.Buffer{}, OutputFormatText, NewLocalBackend(root),
+			NewLocalBackend(root))
+
+		err := option(s3c)
+		if err == nil || !strings.HasPrefix(err.Error(), fileURLPrefix) {
+			t.Errorf("%s with local backends: expected an error naming the location; got %v", name, err)
+		}
+	}
+}
+
+func TestComparePrefixesThroughBackend(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := newMemoryBackend("bucket2")
+
+	backend1.put("src/a", "1", modified)
+	backend1.put("src/d/b", "1", modified)
+	backend1.put("other/a", "1", modified)
+	backend2.put("dst/a", "1", modified)
+	backend2.put("dst/d/b", "22", modified)
+	backend2.put("dst/e/c", "1", modified)
+
+	output := &bytes.Buffer{}
+	s3c := NewS3Comparer(context.Background(), output, OutputFormatText, backend1, backend2)
+	summary := s3c.ComparePrefixes("src/", "dst/")
+
+	if summary.Compared != 2 || summary.Mismatched != 1 || summary.OnlyIn1 != 0 || summary.OnlyIn2 != 1 {
+		t.Errorf("expected 2 keys compared, 1 mismatched, and 1 only in the second location; got %+v:\n%s", summary,
+			output)
+	}
+
+	for _, expected := range []string{
+		"--- mem://bucket1/src/d/b", "+++ mem://bucket2/dst/d/b", "Only in mem://bucket2/dst/: e/",
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("expected output to contain %#v; got:\n%s", expected, output)
+		}
+	}
+
+	// Only the prefixes being compared are listed.
+	for _, name := range backend1.listedNames() {
+		if !strings.HasPrefix(name, "src/") {
+			t.Errorf("expected only src/ to be listed; got %#v", name)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package s3compare
+
+import (
+	"crypto/md5"  //nolint:gosec // Used for content comparison, not for security.
+	"crypto/sha1" //nolint:gosec // Used for content comparison, not for security.
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"sort"
+)
+
+const DefaultContentHash = "sha256"
+
+var contentHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// ContentHashNames returns the names of the supported content hash algorithms, sorted.
+func ContentHashNames() []string {
+	names := make([]string, 0, len(contentHashes))
+	for name := range contentHashes {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func getContentHash(name string) (func() hash.Hash, error) {
+	newHash, found := contentHashes[name]
+	if !found {
+		return nil, fmt.Errorf("unsupported content hash algorithm: %#v", name)
+	}
+
+	return newHash, nil
+}
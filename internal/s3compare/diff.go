@@ -4,26 +4,87 @@ import "fmt"
 
 type OutputFormat int
 
+// OutputFormatJSON writes a JSON array of DiffReports, which is only complete once the comparison finishes.
+// OutputFormatNDJSON writes each DiffReport as a JSON object on a line of its own, so partial output remains valid.
+// OutputFormatCSV and OutputFormatTSV write a table with a row for each DiffReport once the comparison finishes (see
+// writeTable). OutputFormatHTML writes a self-contained HTML page once the comparison finishes (see writeHTML).
 const (
 	OutputFormatText OutputFormat = iota
 	OutputFormatJSON
+	OutputFormatNDJSON
+	OutputFormatCSV
+	OutputFormatTSV
+	OutputFormatHTML
 )
 
+// DiffObject identifies one of the objects in a DiffReport. VersionID is set when a specific version of the object was
+// examined (when comparing versions or comparing as of a point in time).
 type DiffObject struct {
 	URL          string `json:"Url"`
+	VersionID    string `json:"VersionId,omitempty"`
 	LastModified string `json:"LastModified,omitempty"`
 }
 
+// displayName returns the URL of the object, qualified with the version ID (as in S3 HTTP URLs) if one is set.
+func (do *DiffObject) displayName() string {
+	if do.VersionID == "" {
+		return do.URL
+	}
+
+	return do.URL + "?versionId=" + do.VersionID
+}
+
+// KeyMapping records the mapping of a key (or directory) in the first location to the one expected in the second,
+// as paths relative to the prefixes being compared.
+type KeyMapping struct {
+	Key1 string `json:"Key1"`
+	Key2 string `json:"Key2"`
+}
+
 type DiffType string
 
 const DiffTypeMissing DiffType = DiffType("Missing")
 const DiffTypeMismatch DiffType = DiffType("Mismatch")
+const DiffTypeContentMismatch DiffType = DiffType("ContentMismatch")
+const DiffTypeVersionMismatch DiffType = DiffType("VersionMismatch")
+const DiffTypeDeleteMarker DiffType = DiffType("DeleteMarker")
+const DiffTypeError DiffType = DiffType("Error")
+
+// DiffTypeSummary is the type of the summary written at the end of JSON output, which isn't a difference.
+const DiffTypeSummary DiffType = DiffType("Summary")
 
+// DiffError describes an error that prevented part of the locations from being compared: the operation that failed
+// (named for the S3 API call), the error code (if the service returned one), and the message.
+type DiffError struct {
+	Operation string `json:"Operation"`
+	Code      string `json:"Code,omitempty"`
+	Message   string `json:"Message"`
+}
+
+// DiffReport describes a difference found between the two locations.
+//
+// Equivalences holds headers whose values differ but which were determined to be equivalent, keyed by header name,
+// with the reason as the value. These are not counted as differences.
+//
+// KeyMapping is set if the key in the first location was mapped to a different key in the second location (which, if
+// the Type is Missing, is the key that wasn't found).
+//
+// Error is set if the Type is Error. The object (or prefix) that couldn't be read is given in the same position as for
+// a Missing report.
 type DiffReport struct {
 	Type          DiffType            `json:"Type"`
 	Objects       []DiffObject        `json:"DiffObjects"`
 	CommonHeaders map[string]string   `json:"CommonHeaders,omitempty"`
 	DiffHeaders   map[string][]string `json:"DiffHeaders,omitempty"`
+	Equivalences  map[string]string   `json:"Equivalences,omitempty"`
+	KeyMapping    *KeyMapping         `json:"KeyMapping,omitempty"`
+	Error         *DiffError          `json:"Error,omitempty"`
+}
+
+// summaryReport is the JSON form of a Summary written at the end of the output.
+type summaryReport struct {
+	Type    DiffType `json:"Type"`
+	Summary *Summary `json:"Summary"`
 }
 
 type DiffObjectPosition int
@@ -34,6 +95,11 @@ const (
 )
 
 func MissingDiffReport(url string, position DiffObjectPosition) *DiffReport {
+	return OnlyInDiffReport(DiffTypeMissing, url, position)
+}
+
+// OnlyInDiffReport returns a report of the given type for an object found in only one location.
+func OnlyInDiffReport(diffType DiffType, url string, position DiffObjectPosition) *DiffReport {
 	empty := DiffObject{URL: ""}
 	obj := DiffObject{URL: url}
 
@@ -49,7 +115,7 @@ func MissingDiffReport(url string, position DiffObjectPosition) *DiffReport {
 	}
 
 	return &DiffReport{
-		Type:    DiffTypeMissing,
+		Type:    diffType,
 		Objects: objects,
 	}
 }
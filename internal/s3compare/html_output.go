@@ -0,0 +1,305 @@
+package s3compare
+
+import (
+	"bytes"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+)
+
+// htmlPage is the data from which HTML output is rendered.
+type htmlPage struct {
+	URL1              string
+	URL2              string
+	Summary           *Summary
+	Elapsed           string
+	MismatchedHeaders []htmlHeaderCount
+	EquivalentHeaders []htmlHeaderCount
+	Root              *htmlNode
+}
+
+type htmlHeaderCount struct {
+	Header string
+	Count  uint64
+}
+
+// htmlNode is a directory (subprefix) in the tree of reports, relative to the prefixes being compared. Count is the
+// number of reports in it, at any depth.
+type htmlNode struct {
+	Name     string
+	Count    int
+	Children []*htmlNode
+	Reports  []*htmlReport
+
+	childrenByName map[string]*htmlNode
+}
+
+// htmlReport is a DiffReport as rendered in HTML output. Category is the class used to filter it: missing (including
+// delete markers), mismatch, or error.
+type htmlReport struct {
+	Name          string
+	Type          DiffType
+	Category      string
+	Name1         string
+	Name2         string
+	LastModified1 string
+	LastModified2 string
+	Rows          []htmlHeaderRow
+	Error         *DiffError
+	KeyMapping    *KeyMapping
+}
+
+// htmlHeaderRow is a row of the header table of a report.
+type htmlHeaderRow struct {
+	Header      string
+	Value1      string
+	Value2      string
+	Differs     bool
+	Equivalence string
+}
+
+// writeHTML writes the reports held as a self-contained HTML page: the summary, followed by a tree of the
+// subprefixes containing reports, each of which can be collapsed. Mismatches have a table of headers with the differing
+// values highlighted. Reports can be filtered by category.
+func (s3c *S3Comparer) writeHTML(summary *Summary) error {
+	s3c.outputMutex.Lock()
+	defer s3c.outputMutex.Unlock()
+
+	page := &htmlPage{
+		URL1:    s3c.handler1.url(s3c.rootPrefix1),
+		URL2:    s3c.handler2.url(s3c.rootPrefix2),
+		Summary: summary,
+		Elapsed: time.Duration(summary.ElapsedSeconds * float64(time.Second)).Round(time.Millisecond).String(),
+		Root:    &htmlNode{childrenByName: make(map[string]*htmlNode)},
+	}
+
+	for _, header := range sortedHeaders(summary.MismatchedHeaders) {
+		page.MismatchedHeaders = append(page.MismatchedHeaders,
+			htmlHeaderCount{Header: header, Count: summary.MismatchedHeaders[header]})
+	}
+
+	for _, header := range sortedHeaders(summary.EquivalentHeaders) {
+		page.EquivalentHeaders = append(page.EquivalentHeaders,
+			htmlHeaderCount{Header: header, Count: summary.EquivalentHeaders[header]})
+	}
+
+	for _, dr := range s3c.heldReports {
+		path := strings.TrimPrefix(dr.Objects[FirstObject].URL, page.URL1)
+		if dr.Objects[FirstObject].URL == "" {
+			path = strings.TrimPrefix(dr.Objects[SecondObject].URL, page.URL2)
+		}
+
+		page.Root.add(path, newHTMLReport(dr))
+	}
+
+	page.Root.sort()
+
+	buf := &bytes.Buffer{}
+	if err := htmlTemplate.Execute(buf, page); err != nil {
+		return err
+	}
+
+	return s3c.write(buf.Bytes())
+}
+
+// add adds a report on the given path (relative to this node) to the tree, creating the directories on the path.
+func (node *htmlNode) add(path string, report *htmlReport) {
+	node.Count++
+
+	slash := strings.IndexByte(path, '/')
+	if slash < 0 || slash == len(path)-1 {
+		report.Name = path
+		if report.Name == "" {
+			report.Name = "./"
+		}
+
+		node.Reports = append(node.Reports, report)
+
+		return
+	}
+
+	name := path[:slash+1]
+
+	child := node.childrenByName[name]
+	if child == nil {
+		child = &htmlNode{Name: name, childrenByName: make(map[string]*htmlNode)}
+		node.childrenByName[name] = child
+		node.Children = append(node.Children, child)
+	}
+
+	child.add(path[slash+1:], report)
+}
+
+// sort orders the children and reports of this node, and of every node under it, by name.
+func (node *htmlNode) sort() {
+	sort.Slice(node.Children, func(i, j int) bool { return node.Children[i].Name < node.Children[j].Name })
+	sort.SliceStable(node.Reports, func(i, j int) bool { return node.Reports[i].Name < node.Reports[j].Name })
+
+	for _, child := range node.Children {
+		child.sort()
+	}
+}
+
+func newHTMLReport(dr *DiffReport) *htmlReport {
+	report := &htmlReport{
+		Type:          dr.Type,
+		Name1:         dr.Objects[FirstObject].displayName(),
+		Name2:         dr.Objects[SecondObject].displayName(),
+		LastModified1: dr.Objects[FirstObject].LastModified,
+		LastModified2: dr.Objects[SecondObject].LastModified,
+		Error:         dr.Error,
+		KeyMapping:    dr.KeyMapping,
+	}
+
+	switch dr.Type {
+	case DiffTypeMissing, DiffTypeDeleteMarker:
+		report.Category = "missing"
+	case DiffTypeError:
+		report.Category = "error"
+	default:
+		report.Category = "mismatch"
+	}
+
+	headers := make([]string, 0, len(dr.CommonHeaders)+len(dr.DiffHeaders))
+	for header := range dr.CommonHeaders {
+		headers = append(headers, header)
+	}
+
+	for header := range dr.DiffHeaders {
+		headers = append(headers, header)
+	}
+
+	sort.Strings(headers)
+
+	for _, header := range headers {
+		if value, found := dr.CommonHeaders[header]; found {
+			report.Rows = append(report.Rows, htmlHeaderRow{Header: header, Value1: value, Value2: value})
+			continue
+		}
+
+		values := dr.DiffHeaders[header]
+		report.Rows = append(report.Rows, htmlHeaderRow{
+			Header:      header,
+			Value1:      values[0],
+			Value2:      values[1],
+			Differs:     true,
+			Equivalence: dr.Equivalences[header],
+		})
+	}
+
+	return report
+}
+
+var htmlTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Comparison of {{.URL1}} and {{.URL2}}</title>
+<style>
+body { font-family: sans-serif; margin: 1.5em; color: #222; }
+h1 { font-size: 1.3em; }
+code, td.value { font-family: monospace; }
+table { border-collapse: collapse; margin: 0.4em 0 0.8em 0; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; vertical-align: top; }
+th { background: #f0f0f0; }
+details { margin-left: 1.2em; }
+details > summary { cursor: pointer; font-family: monospace; }
+.tree { margin-left: -1.2em; }
+.count { color: #777; font-size: 0.85em; }
+.report { margin: 0.3em 0 0.3em 1.2em; }
+.report .title { font-family: monospace; }
+.type { display: inline-block; min-width: 9em; font-family: sans-serif; font-size: 0.85em; font-weight: bold; }
+.missing .type { color: #a60; }
+.mismatch .type { color: #b00; }
+.error .type { color: #70a; }
+tr.differs td.value { background: #fdd; }
+tr.differs td.value + td.value { background: #dfd; }
+tr.equivalent td.value { background: #ffd; }
+.filters { margin: 1em 0; }
+.filters label { margin-right: 1em; }
+body.hide-missing .report.missing, body.hide-mismatch .report.mismatch, body.hide-error .report.error {
+    display: none;
+}
+</style>
+</head>
+<body>
+<h1>Comparison of <code>{{.URL1}}</code> and <code>{{.URL2}}</code></h1>
+<table class="summary">
+<tr><th>Prefixes compared</th><td>{{.Summary.Prefixes}}</td></tr>
+<tr><th>Keys compared</th><td>{{.Summary.Compared}}</td></tr>
+<tr><th>Only in <code>{{.URL1}}</code></th><td>{{.Summary.OnlyIn1}}</td></tr>
+<tr><th>Only in <code>{{.URL2}}</code></th><td>{{.Summary.OnlyIn2}}</td></tr>
+<tr><th>Mismatched</th><td>{{.Summary.Mismatched}}</td></tr>
+{{- range .MismatchedHeaders}}
+<tr><th>&nbsp;&nbsp;<code>{{.Header}}</code></th><td>{{.Count}}</td></tr>
+{{- end}}
+{{- range .EquivalentHeaders}}
+<tr><th>Equivalent <code>{{.Header}}</code></th><td>{{.Count}}</td></tr>
+{{- end}}
+<tr><th>Errors</th><td>{{.Summary.Errored}}</td></tr>
+<tr><th>Bytes compared in <code>{{.URL1}}</code></th><td>{{.Summary.Bytes1}}</td></tr>
+<tr><th>Bytes compared in <code>{{.URL2}}</code></th><td>{{.Summary.Bytes2}}</td></tr>
+<tr><th>Calls to <code>{{.URL1}}</code></th><td>{{.Summary.Calls1}}</td></tr>
+<tr><th>Calls to <code>{{.URL2}}</code></th><td>{{.Summary.Calls2}}</td></tr>
+<tr><th>Elapsed</th><td>{{.Elapsed}}</td></tr>
+</table>
+<div class="filters">
+<label><input type="checkbox" data-category="missing" checked> Missing</label>
+<label><input type="checkbox" data-category="mismatch" checked> Mismatch</label>
+<label><input type="checkbox" data-category="error" checked> Error</label>
+<button type="button" data-open="true">Expand all</button>
+<button type="button" data-open="false">Collapse all</button>
+</div>
+<div class="tree">
+{{- range .Root.Children}}{{template "node" .}}{{end}}
+{{- range .Root.Reports}}{{template "report" .}}{{end}}
+</div>
+<script>
+document.querySelectorAll(".filters input").forEach(function (input) {
+    input.addEventListener("change", function () {
+        document.body.classList.toggle("hide-" + input.dataset.category, !input.checked);
+    });
+});
+document.querySelectorAll(".filters button").forEach(function (button) {
+    button.addEventListener("click", function () {
+        document.querySelectorAll("details").forEach(function (details) {
+            details.open = button.dataset.open === "true";
+        });
+    });
+});
+</script>
+</body>
+</html>
+{{define "node"}}
+<details open><summary>{{.Name}} <span class="count">({{.Count}})</span></summary>
+{{- range .Children}}{{template "node" .}}{{end}}
+{{- range .Reports}}{{template "report" .}}{{end}}
+</details>
+{{- end}}
+{{define "report"}}
+<div class="report {{.Category}}">
+<div class="title"><span class="type">{{.Type}}</span>{{.Name}}</div>
+{{- if .KeyMapping}}
+<div>Mapped from <code>{{.KeyMapping.Key1}}</code> to <code>{{.KeyMapping.Key2}}</code></div>
+{{- end}}
+{{- if .Error}}
+<div>{{.Error.Operation}} on <code>{{if .Name1}}{{.Name1}}{{else}}{{.Name2}}{{end}}</code> failed:
+{{if .Error.Code}}{{.Error.Code}}: {{end}}{{.Error.Message}}</div>
+{{- else if eq .Category "missing"}}
+<div>Only in <code>{{if .Name1}}{{.Name1}}{{else}}{{.Name2}}{{end}}</code></div>
+{{- else}}
+<table>
+<tr><th>Header</th>
+<th><code>{{.Name1}}</code><br>{{.LastModified1}}</th>
+<th><code>{{.Name2}}</code><br>{{.LastModified2}}</th></tr>
+{{- range .Rows}}
+<tr class="{{if .Equivalence}}equivalent{{else if .Differs}}differs{{end}}"><th><code>{{.Header}}</code></th>
+<td class="value">{{.Value1}}</td>
+<td class="value">{{.Value2}}{{if .Equivalence}}<br>(equivalent: {{.Equivalence}}){{end}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+</div>
+{{- end}}
+`))
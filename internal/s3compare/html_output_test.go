@@ -0,0 +1,81 @@
+package s3compare
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTMLNodeTree(t *testing.T) {
+	root := &htmlNode{childrenByName: make(map[string]*htmlNode)}
+
+	for _, path := range []string{"d/e/b", "a", "d/e/", "c/x", "d/a", "d/e/a"} {
+		root.add(path, &htmlReport{})
+	}
+
+	root.sort()
+
+	// Subprefixes reported as a whole are shown as reports in their parent, not as directories.
+	var describe func(node *htmlNode) string
+	describe = func(node *htmlNode) string {
+		parts := []string{}
+
+		for _, child := range node.Children {
+			parts = append(parts, child.Name+"("+describe(child)+")")
+		}
+
+		for _, report := range node.Reports {
+			parts = append(parts, report.Name)
+		}
+
+		return strings.Join(parts, " ")
+	}
+
+	if tree, expected := describe(root), "c/(x) d/(e/(a b) a e/) a"; tree != expected {
+		t.Errorf("got %#v; expected %#v", tree, expected)
+	}
+
+	if root.Count != 6 || root.childrenByName["d/"].Count != 4 {
+		t.Errorf("expected counts of 6 and 4; got %d and %d", root.Count, root.childrenByName["d/"].Count)
+	}
+}
+
+func TestHTMLOutput(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := newMemoryBackend("bucket2")
+
+	// Keys and header values are escaped.
+	backend1.put("d/<svg onload=alert(1)>", "1", modified)
+	backend1.put("d/k", "1", modified).headers["content-type"] = `<img src=x onerror="alert(1)">`
+	backend2.put("d/k", "1", modified).headers["content-type"] = "text/plain"
+
+	output := &bytes.Buffer{}
+	s3c := NewS3Comparer(context.Background(), output, OutputFormatHTML, backend1, backend2)
+	s3c.ComparePrefixes("", "")
+
+	page := output.String()
+
+	for _, unexpected := range []string{"<svg", "<img"} {
+		if strings.Contains(page, unexpected) {
+			t.Errorf("expected %#v to be escaped; got:\n%s", unexpected, page)
+		}
+	}
+
+	for _, expected := range []string{
+		"<tr><th>Keys compared</th><td>1</td></tr>",
+		"<tr><th>&nbsp;&nbsp;<code>content-type</code></th><td>1</td></tr>",
+		`<details open><summary>d/ <span class="count">(2)</span></summary>`,
+		`<div class="report missing">`,
+		`<div class="title"><span class="type">Missing</span>&lt;svg onload=alert(1)&gt;</div>`,
+		`<tr class="differs"><th><code>content-type</code></th>`,
+		`<td class="value">&lt;img src=x onerror=&#34;alert(1)&#34;&gt;</td>`,
+		`<tr class=""><th><code>content-length</code></th>`,
+	} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("expected the page to contain %#v; got:\n%s", expected, page)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package s3compare
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// regexPatternPrefix marks an include or exclude pattern as a regular expression rather than a glob.
+const regexPatternPrefix = "re:"
+
+// pathPattern matches key paths relative to the prefixes being compared. Directories (subprefixes) are matched with
+// their trailing "/".
+type pathPattern struct {
+	re *regexp.Regexp
+
+	// dirRe, if not nil, matches directories (without their trailing "/") whose contents re matches entirely: those
+	// matched by the part of a glob preceding a trailing "/**".
+	dirRe *regexp.Regexp
+
+	// glob indicates the pattern was a glob, and dirOnly that it ended in "/" (and only matches directories).
+	glob    bool
+	dirOnly bool
+
+	// literalPrefix is the part of a glob anchored at the top level preceding its first wildcard. Only paths beginning
+	// with it (or directories it begins with) can match. It is empty if the pattern can match at any depth.
+	literalPrefix string
+	anchored      bool
+}
+
+// newPathPattern parses an include or exclude pattern: a regular expression if it begins with "re:", or else a glob.
+//
+// In a glob, "*" matches any sequence of characters other than "/", "?" matches any one character other than "/",
+// "[...]" matches a character class ("[!...]" negated), "**" matches any sequence of characters including "/", and
+// "\" quotes the next character. A glob containing no "/" (other than a trailing one) matches the last component of
+// a path at any depth; otherwise, it matches the whole path from the top level. A glob ending in "/" only matches
+// directories, and one ending in "/**" also matches the directory preceding it.
+//
+// A regular expression matches if it matches any part of the path; directories end in "/".
+func newPathPattern(pattern string) (*pathPattern, error) {
+	if pattern == "" {
+		return nil, errors.New("empty pattern")
+	}
+
+	if strings.HasPrefix(pattern, regexPatternPrefix) {
+		re, err := regexp.Compile(pattern[len(regexPatternPrefix):])
+		if err != nil {
+			return nil, err
+		}
+
+		return &pathPattern{re: re}, nil
+	}
+
+	pp := &pathPattern{glob: true}
+
+	if strings.HasSuffix(pattern, "/") {
+		pp.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+
+	if strings.Contains(pattern, "/") {
+		pp.anchored = true
+		pattern = strings.TrimLeft(pattern, "/")
+	}
+
+	if pattern == "" {
+		return nil, errors.New("pattern matches nothing")
+	}
+
+	expr, literalPrefix, err := globToRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if pp.anchored {
+		pp.literalPrefix = literalPrefix
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(?:.*/)?" + expr + "$"
+	}
+
+	pp.re, err = regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	if dir := strings.TrimSuffix(pattern, "/**"); dir != pattern && dir != "" && !strings.HasSuffix(dir, "\\") {
+		dirExpr, _, err := globToRegexp(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		if pp.anchored {
+			dirExpr = "^" + dirExpr + "$"
+		} else {
+			dirExpr = "^(?:.*/)?" + dirExpr + "$"
+		}
+
+		pp.dirRe, err = regexp.Compile(dirExpr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pp, nil
+}
+
+// globToRegexp translates a glob into an unanchored regular expression, also returning the literal text preceding
+// its first wildcard.
+func globToRegexp(glob string) (string, string, error) {
+	expr := &strings.Builder{}
+	literal := &strings.Builder{}
+	wildcardSeen := false
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+
+		switch c {
+		case '*':
+			wildcardSeen = true
+
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+
+				// "**/" also matches no directories at all.
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					i++
+					expr.WriteString("(?:.*/)?")
+				} else {
+					expr.WriteString(".*")
+				}
+			} else {
+				expr.WriteString("[^/]*")
+			}
+
+		case '?':
+			wildcardSeen = true
+			expr.WriteString("[^/]")
+
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", "", fmt.Errorf("unterminated character class in %#v", glob)
+			}
+
+			wildcardSeen = true
+			class := glob[i+1 : i+1+end]
+
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			expr.WriteString("[" + strings.ReplaceAll(class, "\\", "\\\\") + "]")
+			i += end + 1
+
+		default:
+			if c == '\\' && i+1 < len(glob) {
+				i++
+				c = glob[i]
+			}
+
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+
+			if !wildcardSeen {
+				literal.WriteByte(c)
+			}
+		}
+	}
+
+	return expr.String(), literal.String(), nil
+}
+
+// matchKey indicates whether the pattern matches a key.
+func (pp *pathPattern) matchKey(key string) bool {
+	return !pp.dirOnly && pp.re.MatchString(key)
+}
+
+// matchDir indicates whether the pattern matches a directory (ending in "/").
+func (pp *pathPattern) matchDir(dir string) bool {
+	if pp.glob {
+		dir = strings.TrimSuffix(dir, "/")
+		return pp.re.MatchString(dir) || pp.dirRe != nil && pp.dirRe.MatchString(dir)
+	}
+
+	return pp.re.MatchString(dir)
+}
+
+// mayMatchUnder indicates whether the pattern could match a directory (ending in "/") or anything under it.
+func (pp *pathPattern) mayMatchUnder(dir string) bool {
+	if !pp.anchored {
+		return true
+	}
+
+	return strings.HasPrefix(dir, pp.literalPrefix) || strings.HasPrefix(pp.literalPrefix, dir)
+}
+
+// keyFilter selects the keys to compare by their paths relative to the prefixes being compared. A key is compared if
+// it matches an include pattern (or is in a directory that does), or if there are none, and neither it nor any of its
+// directories matches an exclude pattern.
+type keyFilter struct {
+	includes []*pathPattern
+	excludes []*pathPattern
+}
+
+// includeDir indicates whether a directory (ending in "/") might contain keys to compare, and so should be listed.
+// Its parent directories are assumed to have been checked already.
+func (kf *keyFilter) includeDir(dir string) bool {
+	for _, exclude := range kf.excludes {
+		if exclude.matchDir(dir) {
+			return false
+		}
+	}
+
+	if len(kf.includes) == 0 {
+		return true
+	}
+
+	for _, include := range kf.includes {
+		if include.mayMatchUnder(dir) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// includeKey indicates whether a key should be compared. Unlike includeDir, its directories are checked as well, since
+// recursive listings don't list them separately.
+func (kf *keyFilter) includeKey(key string) bool {
+	for _, exclude := range kf.excludes {
+		if exclude.matchKey(key) {
+			return false
+		}
+	}
+
+	included := len(kf.includes) == 0
+
+	for _, include := range kf.includes {
+		if include.matchKey(key) {
+			included = true
+			break
+		}
+	}
+
+	for slash := strings.IndexByte(key, '/'); slash >= 0; slash = nextSlash(key, slash) {
+		dir := key[:slash+1]
+
+		for _, exclude := range kf.excludes {
+			if exclude.matchDir(dir) {
+				return false
+			}
+		}
+
+		for _, include := range kf.includes {
+			if !included && include.matchDir(dir) {
+				included = true
+			}
+		}
+	}
+
+	return included
+}
+
+// nextSlash returns the index of the next "/" in s following the one at index i, or -1 if there is none.
+func nextSlash(s string, i int) int {
+	next := strings.IndexByte(s[i+1:], '/')
+	if next < 0 {
+		return -1
+	}
+
+	return i + 1 + next
+}
@@ -0,0 +1,175 @@
+package s3compare
+
+import (
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob    string
+		expr    string
+		literal string
+	}{
+		{glob: "a.txt", expr: `a\.txt`, literal: "a.txt"},
+		{glob: "*.crc", expr: `[^/]*\.crc`, literal: ""},
+		{glob: "logs/202?/*", expr: `logs/202[^/]/[^/]*`, literal: "logs/202"},
+		{glob: "a/**/b", expr: `a/(?:.*/)?b`, literal: "a/"},
+		{glob: "a/**", expr: `a/.*`, literal: "a/"},
+		{glob: "[!a-c]x", expr: `[^a-c]x`, literal: ""},
+		{glob: `\*x`, expr: `\*x`, literal: "*x"},
+	}
+
+	for _, test := range tests {
+		expr, literal, err := globToRegexp(test.glob)
+		if err != nil {
+			t.Errorf("globToRegexp(%#v): unexpected error %v", test.glob, err)
+			continue
+		}
+
+		if expr != test.expr || literal != test.literal {
+			t.Errorf("globToRegexp(%#v): got %#v, %#v; expected %#v, %#v", test.glob, expr, literal, test.expr,
+				test.literal)
+		}
+	}
+
+	if _, _, err := globToRegexp("a[bc"); err == nil {
+		t.Error("globToRegexp(\"a[bc\"): expected an error for an unterminated character class")
+	}
+}
+
+func TestPathPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		keys    map[string]bool
+		dirs    map[string]bool
+	}{
+		{
+			pattern: "*.crc",
+			keys:    map[string]bool{"a.crc": true, "d/e/a.crc": true, "a.crc.txt": false},
+			dirs:    map[string]bool{"x.crc/": true, "d/": false},
+		},
+		{
+			pattern: "_temporary/",
+			keys:    map[string]bool{"_temporary": false},
+			dirs:    map[string]bool{"_temporary/": true, "d/_temporary/": true, "d/": false},
+		},
+		{
+			pattern: "d/*.txt",
+			keys:    map[string]bool{"d/a.txt": true, "e/d/a.txt": false, "d/e/a.txt": false},
+			dirs:    map[string]bool{"d/": false},
+		},
+		{
+			pattern: "d/e/**",
+			keys:    map[string]bool{"d/e/a": true, "d/e/f/a": true, "d/a": false},
+			dirs:    map[string]bool{"d/e/": true, "d/e/f/": true, "d/": false, "d/ef/": false},
+		},
+		{
+			pattern: "/a.txt",
+			keys:    map[string]bool{"a.txt": true, "d/a.txt": false},
+		},
+		{
+			pattern: "re:\\.json$",
+			keys:    map[string]bool{"a.json": true, "a.json.gz": false},
+			dirs:    map[string]bool{"a.json/": false},
+		},
+	}
+
+	for _, test := range tests {
+		pp, err := newPathPattern(test.pattern)
+		if err != nil {
+			t.Errorf("newPathPattern(%#v): unexpected error %v", test.pattern, err)
+			continue
+		}
+
+		for key, expected := range test.keys {
+			if matched := pp.matchKey(key); matched != expected {
+				t.Errorf("%#v matching key %#v: got %v; expected %v", test.pattern, key, matched, expected)
+			}
+		}
+
+		for dir, expected := range test.dirs {
+			if matched := pp.matchDir(dir); matched != expected {
+				t.Errorf("%#v matching directory %#v: got %v; expected %v", test.pattern, dir, matched, expected)
+			}
+		}
+	}
+
+	for _, pattern := range []string{"", "/", "re:(", "[a"} {
+		if _, err := newPathPattern(pattern); err == nil {
+			t.Errorf("newPathPattern(%#v): expected an error", pattern)
+		}
+	}
+}
+
+func TestKeyFilter(t *testing.T) {
+	newFilter := func(includes, excludes []string) *keyFilter {
+		kf := &keyFilter{}
+
+		for _, pattern := range includes {
+			pp, err := newPathPattern(pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			kf.includes = append(kf.includes, pp)
+		}
+
+		for _, pattern := range excludes {
+			pp, err := newPathPattern(pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			kf.excludes = append(kf.excludes, pp)
+		}
+
+		return kf
+	}
+
+	tests := []struct {
+		includes []string
+		excludes []string
+		keys     map[string]bool
+		dirs     map[string]bool
+	}{
+		{
+			excludes: []string{"*.crc", "_temporary/"},
+			keys:     map[string]bool{"a.txt": true, "d/a.crc": false, "d/_temporary/a.txt": false},
+			dirs:     map[string]bool{"d/": true, "d/_temporary/": false},
+		},
+		{
+			includes: []string{"logs/2026/"},
+			keys:     map[string]bool{"logs/2026/a": true, "logs/2026/d/a": true, "logs/2025/a": false, "a": false},
+			dirs:     map[string]bool{"logs/": true, "logs/2026/": true, "logs/2025/": false, "data/": false},
+		},
+		{
+			includes: []string{"*.json"},
+			excludes: []string{"tmp/"},
+			keys:     map[string]bool{"d/a.json": true, "d/a.txt": false, "tmp/a.json": false},
+			dirs:     map[string]bool{"d/": true, "tmp/": false},
+		},
+		{
+			excludes: []string{"logs/**"},
+			keys:     map[string]bool{"logs/a": false, "logs/d/a": false, "logs.txt": true},
+			dirs:     map[string]bool{"logs/": false, "data/": true},
+		},
+	}
+
+	for _, test := range tests {
+		kf := newFilter(test.includes, test.excludes)
+
+		for key, expected := range test.keys {
+			if included := kf.includeKey(key); included != expected {
+				t.Errorf("include %#v, exclude %#v: includeKey(%#v): got %v; expected %v", test.includes,
+					test.excludes, key, included, expected)
+			}
+		}
+
+		for dir, expected := range test.dirs {
+			if included := kf.includeDir(dir); included != expected {
+				t.Errorf("include %#v, exclude %#v: includeDir(%#v): got %v; expected %v", test.includes,
+					test.excludes, dir, included, expected)
+			}
+		}
+	}
+}
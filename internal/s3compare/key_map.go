@@ -0,0 +1,92 @@
+package s3compare
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// keyMapRule is a regular expression substitution applied to key paths.
+type keyMapRule struct {
+	re          *regexp.Regexp
+	replacement string
+	global      bool
+}
+
+// parseKeyMapRule parses a substitution in the style of sed: s/regex/replacement/, optionally followed by g to replace
+// every match rather than the first. Any character may be used in place of "/"; it can be included in the regex or
+// replacement by preceding it with "\". The replacement may refer to submatches as $1 or ${name}.
+func parseKeyMapRule(rule string) (*keyMapRule, error) {
+	if len(rule) < 2 || rule[0] != 's' {
+		return nil, errors.New("expected s/regex/replacement/")
+	}
+
+	delim := rule[1]
+	parts := []string{}
+	part := &strings.Builder{}
+
+	for i := 2; i < len(rule); i++ {
+		c := rule[i]
+
+		switch {
+		case c == '\\' && i+1 < len(rule) && rule[i+1] == delim:
+			part.WriteByte(delim)
+			i++
+		case c == delim:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(c)
+		}
+	}
+
+	if len(parts) != 2 {
+		return nil, errors.New("expected s/regex/replacement/")
+	}
+
+	flags := part.String()
+	if flags != "" && flags != "g" {
+		return nil, fmt.Errorf("unknown flags %#v", flags)
+	}
+
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &keyMapRule{re: re, replacement: parts[1], global: flags == "g"}, nil
+}
+
+// apply returns path with the substitution made.
+func (kmr *keyMapRule) apply(path string) string {
+	if kmr.global {
+		return kmr.re.ReplaceAllString(path, kmr.replacement)
+	}
+
+	match := kmr.re.FindStringSubmatchIndex(path)
+	if match == nil {
+		return path
+	}
+
+	result := []byte(path[:match[0]])
+	result = kmr.re.ExpandString(result, kmr.replacement, path, match)
+
+	return string(result) + path[match[1]:]
+}
+
+// keyMapper maps key paths in the first location (relative to the prefix being compared) to the paths expected in the
+// second location by applying each rule in turn.
+type keyMapper struct {
+	rules []*keyMapRule
+}
+
+// mapPath returns the path expected in the second location for the given path in the first. Directories are mapped
+// with their trailing "/".
+func (km *keyMapper) mapPath(path string) string {
+	for _, rule := range km.rules {
+		path = rule.apply(path)
+	}
+
+	return path
+}
@@ -0,0 +1,104 @@
+package s3compare
+
+import (
+	"testing"
+)
+
+func TestParseKeyMapRule(t *testing.T) {
+	tests := []struct {
+		rule     string
+		path     string
+		expected string
+	}{
+		{rule: `s/\.json$/.json.gz/`, path: "d/a.json", expected: "d/a.json.gz"},
+		{rule: `s|^year=([0-9]+)/|$1/|`, path: "year=2026/a", expected: "2026/a"},
+		{rule: `s/a/b/`, path: "aaa", expected: "baa"},
+		{rule: `s/a/b/g`, path: "aaa", expected: "bbb"},
+		{rule: `s/\//-/g`, path: "a/b/c", expected: "a-b-c"},
+		{rule: `s/(?P<name>[a-z]+)\.txt/${name}.md/`, path: "d/readme.txt", expected: "d/readme.md"},
+		{rule: `s/x/y/`, path: "abc", expected: "abc"},
+	}
+
+	for _, test := range tests {
+		kmr, err := parseKeyMapRule(test.rule)
+		if err != nil {
+			t.Errorf("parseKeyMapRule(%#v): unexpected error %v", test.rule, err)
+			continue
+		}
+
+		if mapped := kmr.apply(test.path); mapped != test.expected {
+			t.Errorf("%s applied to %#v: got %#v; expected %#v", test.rule, test.path, mapped, test.expected)
+		}
+	}
+
+	for _, rule := range []string{"", "s", "x/a/b/", "s/a/", "s/a/b/c/", "s/a/b/i", "s/(/b/"} {
+		if _, err := parseKeyMapRule(rule); err == nil {
+			t.Errorf("parseKeyMapRule(%#v): expected an error", rule)
+		}
+	}
+}
+
+func TestKeyMapperMapPath(t *testing.T) {
+	km := &keyMapper{}
+
+	for _, rule := range []string{`s|^raw/|cooked/|`, `s/\.csv$/.csv.gz/`} {
+		kmr, err := parseKeyMapRule(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		km.rules = append(km.rules, kmr)
+	}
+
+	tests := map[string]string{
+		"raw/a.csv":  "cooked/a.csv.gz",
+		"raw/":       "cooked/",
+		"other/a.md": "other/a.md",
+	}
+
+	for path, expected := range tests {
+		if mapped := km.mapPath(path); mapped != expected {
+			t.Errorf("mapPath(%#v): got %#v; expected %#v", path, mapped, expected)
+		}
+	}
+}
+
+func TestListStreamMapName(t *testing.T) {
+	kmr, err := parseKeyMapRule(`s|^d/(.*)\.txt$|e/$1.md|`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapper := &keyMapper{rules: []*keyMapRule{kmr}}
+
+	tests := []struct {
+		base       string
+		mappedBase string
+		recursive  bool
+		name       string
+		expected   string
+		err        bool
+	}{
+		{recursive: true, name: "d/a.txt", expected: "e/a.md"},
+		{recursive: true, name: "d/x/a.txt", expected: "e/x/a.md"},
+		{recursive: false, base: "d/", mappedBase: "d/", name: "a.txt", err: true},
+		{recursive: false, base: "d/", mappedBase: "e/", name: "a.txt", expected: "a.md"},
+		{recursive: false, base: "d/", mappedBase: "e/", name: "b.bin", err: true},
+		{recursive: false, base: "", mappedBase: "", name: "d/x/a.txt", err: true},
+	}
+
+	for _, test := range tests {
+		ls := &listStream{mapper: mapper, base: test.base, mappedBase: test.mappedBase, recursive: test.recursive}
+
+		mapped, err := ls.mapName(test.name, false)
+
+		switch {
+		case test.err && err == nil:
+			t.Errorf("mapName(%#v) in %#v: expected an error; got %#v", test.name, test.base, mapped)
+		case !test.err && err != nil:
+			t.Errorf("mapName(%#v) in %#v: unexpected error %v", test.name, test.base, err)
+		case !test.err && mapped != test.expected:
+			t.Errorf("mapName(%#v) in %#v: got %#v; expected %#v", test.name, test.base, mapped, test.expected)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package s3compare
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// listItem is a subprefix or a listed object, in the combined key order of a listing.
+type listItem struct {
+	name   string
+	object *ListedObject // nil for subprefixes
+
+	// listedName is the name as listed, if the name has been mapped to the one expected in the other location.
+	// mapErr is the reason the name couldn't be mapped, if it couldn't.
+	listedName string
+	mapErr     error
+}
+
+// sortedListItems returns the subprefixes and objects of a page as a single sequence in key order. Versions of the
+// same key are kept in their listed order.
+func sortedListItems(page *ListPage) []listItem {
+	items := make([]listItem, 0, len(page.Subprefixes)+len(page.Objects))
+
+	for _, subprefix := range page.Subprefixes {
+		items = append(items, listItem{name: subprefix})
+	}
+
+	for i := range page.Objects {
+		items = append(items, listItem{name: page.Objects[i].Key, object: &page.Objects[i]})
+	}
+
+	sort.SliceStable(items, func(i, j int) bool { return items[i].name < items[j].name })
+
+	return items
+}
+
+// listEntry is a subprefix, or a key with its listed versions (newest first; just the one unless versions are being
+// listed). The entries of the first location may be mapped to the names expected in the second location; listedName
+// is the name as listed (the same as name otherwise). If the name couldn't be mapped, it is the name as listed and
+// mapErr is the reason.
+type listEntry struct {
+	name       string
+	listedName string
+	isPrefix   bool
+	versions   []ListedObject
+	mapErr     error
+}
+
+// listStream reads a listing one entry at a time, with pages fetched in the background as they are needed, so only a
+// page or two from each listing is held in memory.
+type listStream struct {
+	ctx      context.Context
+	pageChan chan *asyncListPageResult
+	stop     chan struct{}
+	items    []listItem
+	done     bool
+	err      error
+
+	// filter, if not nil, selects the entries returned, by their paths relative to the prefixes being compared:
+	// base followed by the name.
+	filter *keyFilter
+	base   string
+
+	// mapper, if not nil, maps the path of each entry to the path expected in the other location, whose listing is of
+	// mappedBase. The whole listing is read and sorted by the mapped names before any entry is returned. Entries that
+	// can't be mapped keep their listed names, with the reason in listEntry.mapErr.
+	mapper     *keyMapper
+	mappedBase string
+	recursive  bool
+}
+
+// newListStream starts listing prefix (with the prefix removed from the names returned). If filter is not nil, only
+// the entries it selects are returned; base is the path of prefix relative to the prefix being compared.
+func newListStream(handler *asyncS3Handler, prefix string, versions, recursive bool, filter *keyFilter, base string,
+) *listStream {
+	ls := &listStream{
+		ctx:       handler.ctx,
+		pageChan:  make(chan *asyncListPageResult, 1),
+		stop:      make(chan struct{}),
+		filter:    filter,
+		base:      base,
+		recursive: recursive,
+	}
+
+	go handler.asyncListPages(prefix, versions, recursive, ls.stop, ls.pageChan)
+
+	return ls
+}
+
+// mapNames causes the names of entries to be mapped using mapper to the names expected in a listing of mappedBase in
+// the other location. Entries that can't be mapped keep their listed names, with the reason set in their mapErr, for
+// the caller to report if they are compared. It must be called before any entries are read.
+func (ls *listStream) mapNames(mapper *keyMapper, mappedBase string) {
+	ls.mapper = mapper
+	ls.mappedBase = mappedBase
+}
+
+// close stops the listing if it hasn't finished. It must be called exactly once.
+func (ls *listStream) close() {
+	close(ls.stop)
+}
+
+// fill reads pages until at least one item is available, returning false if the listing has finished (or failed).
+func (ls *listStream) fill() bool {
+	if ls.mapper != nil {
+		return ls.fillMapped()
+	}
+
+	for len(ls.items) == 0 && !ls.done {
+		ls.items = ls.readPage()
+	}
+
+	return len(ls.items) > 0
+}
+
+// fillMapped reads the whole listing, if it hasn't been read, mapping and sorting the names. Unlike fill, this holds
+// the whole listing in memory, since mapping names can change their order.
+func (ls *listStream) fillMapped() bool {
+	if !ls.done {
+		var items []listItem
+
+		for !ls.done {
+			items = append(items, ls.readPage()...)
+		}
+
+		if ls.err != nil {
+			return false
+		}
+
+		for i := range items {
+			items[i].listedName = items[i].name
+
+			// The versions of a key are listed together; it only needs to be mapped once.
+			if i > 0 && items[i].listedName == items[i-1].listedName {
+				items[i].name = items[i-1].name
+				items[i].mapErr = items[i-1].mapErr
+				continue
+			}
+
+			mapped, err := ls.mapName(items[i].name, items[i].object == nil)
+			if err != nil {
+				items[i].mapErr = err
+				continue
+			}
+
+			items[i].name = mapped
+		}
+
+		sort.SliceStable(items, func(i, j int) bool { return items[i].name < items[j].name })
+
+		for ls.unmapCollisions(items) {
+			sort.SliceStable(items, func(i, j int) bool { return items[i].name < items[j].name })
+		}
+
+		ls.items = items
+	}
+
+	return len(ls.items) > 0
+}
+
+// unmapCollisions finds entries (sorted by their mapped names) mapped to the same name as an entry listed under another
+// name, which can't all be compared with the one entry of that name in the other location. Those that were renamed
+// keep their listed names instead, with the reason in mapErr. It returns whether any were found, in which case the
+// items must be sorted again (and checked again, since their listed names may also collide).
+func (ls *listStream) unmapCollisions(items []listItem) bool {
+	found := false
+
+	for start := 0; start < len(items); {
+		end := start + 1
+		collides := false
+
+		for ; end < len(items) && items[end].name == items[start].name; end++ {
+			if items[end].listedName != items[start].listedName {
+				collides = true
+			}
+		}
+
+		for i := start; collides && i < end; i++ {
+			if items[i].name != items[i].listedName {
+				items[i].mapErr = fmt.Errorf("cannot map to %#v: another entry is mapped to or listed as it",
+					ls.mappedBase+items[i].name)
+				items[i].name = items[i].listedName
+				found = true
+			}
+		}
+
+		start = end
+	}
+
+	return found
+}
+
+// mapName returns the name expected in the other location for an entry. Keys in a delimited listing can't be mapped
+// to another directory, nor subprefixes to anything but a sibling subprefix.
+func (ls *listStream) mapName(name string, isPrefix bool) (string, error) {
+	mapped := ls.mapper.mapPath(ls.base + name)
+
+	if !strings.HasPrefix(mapped, ls.mappedBase) {
+		return "", fmt.Errorf("cannot map to %#v: outside %#v", mapped, ls.mappedBase)
+	}
+
+	mappedName := mapped[len(ls.mappedBase):]
+	slash := strings.Index(mappedName, "/")
+
+	switch {
+	case mappedName == "":
+		return "", fmt.Errorf("cannot map to %#v: the directory being listed", mapped)
+	case ls.recursive:
+		return mappedName, nil
+	case isPrefix && slash != len(mappedName)-1, !isPrefix && slash >= 0:
+		return "", fmt.Errorf("cannot map to %#v in a delimited listing; use -flat", mapped)
+	}
+
+	return mappedName, nil
+}
+
+// unmappedDir returns the directory of a listed name (its path relative to the listing) that is mapped to dir, which
+// must be a directory of the name as mapped, returning false if there is none because the name was mapped to another
+// directory. The listing must be recursive.
+func (ls *listStream) unmappedDir(listedName, dir string) (string, bool) {
+	if dir == "" {
+		return "", true
+	}
+
+	for slash := strings.IndexByte(listedName, '/'); slash >= 0; slash = nextSlash(listedName, slash) {
+		if listedDir := listedName[:slash+1]; ls.mapper.mapPath(listedDir) == dir {
+			return listedDir, true
+		}
+	}
+
+	return "", false
+}
+
+// listedDirs returns the directories of an entry of a recursive listing, as listed, that were mapped to parent and
+// subprefix (directories of its name, with parent containing subprefix). It returns false if there are none, because
+// the entry was mapped to another directory or couldn't be mapped.
+func (ls *listStream) listedDirs(entry *listEntry, parent, subprefix string) (string, string, bool) {
+	if ls.mapper == nil {
+		return parent, subprefix, true
+	}
+
+	if entry.mapErr != nil {
+		return "", "", false
+	}
+
+	listedParent, found := ls.unmappedDir(entry.listedName, parent)
+	if !found {
+		return "", "", false
+	}
+
+	listedSubprefix, found := ls.unmappedDir(entry.listedName, subprefix)
+	if !found || !strings.HasPrefix(listedSubprefix, listedParent) {
+		return "", "", false
+	}
+
+	return listedParent, listedSubprefix, true
+}
+
+// readPage reads the next page of the listing, returning its items in order (which may be none).
+func (ls *listStream) readPage() []listItem {
+	select {
+	case result, ok := <-ls.pageChan:
+		switch {
+		case !ok:
+			ls.done = true
+		case result.Err != nil:
+			ls.err = result.Err
+			ls.done = true
+		default:
+			return ls.filterItems(sortedListItems(result.Page))
+		}
+
+	case <-ls.ctx.Done():
+		ls.err = ls.ctx.Err()
+		ls.done = true
+	}
+
+	return nil
+}
+
+// filterItems removes the items the filter doesn't select.
+func (ls *listStream) filterItems(items []listItem) []listItem {
+	if ls.filter == nil {
+		return items
+	}
+
+	result := items[:0]
+
+	for _, item := range items {
+		path := ls.base + item.name
+
+		if item.object == nil && ls.filter.includeDir(path) || item.object != nil && ls.filter.includeKey(path) {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+// peek returns the name of the next entry without consuming it. It returns false at the end of the listing or if the
+// listing failed; check ls.err to distinguish the two.
+func (ls *listStream) peek() (string, bool) {
+	if !ls.fill() {
+		return "", false
+	}
+
+	return ls.items[0].name, true
+}
+
+// next consumes and returns the next entry. Versions of a key may span pages, so this may wait for the next page.
+func (ls *listStream) next() *listEntry {
+	if !ls.fill() {
+		return nil
+	}
+
+	item := ls.items[0]
+	ls.items = ls.items[1:]
+
+	listedName := item.listedName
+	if listedName == "" {
+		listedName = item.name
+	}
+
+	if item.object == nil {
+		return &listEntry{name: item.name, listedName: listedName, isPrefix: true, mapErr: item.mapErr}
+	}
+
+	entry := &listEntry{
+		name:       item.name,
+		listedName: listedName,
+		versions:   []ListedObject{*item.object},
+		mapErr:     item.mapErr,
+	}
+
+	for ls.fill() && ls.items[0].object != nil && ls.items[0].name == entry.name &&
+		ls.items[0].listedName == item.listedName {
+		entry.versions = append(entry.versions, *ls.items[0].object)
+		ls.items = ls.items[1:]
+	}
+
+	return entry
+}
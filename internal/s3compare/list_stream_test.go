@@ -0,0 +1,125 @@
+package s3compare
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlatListingMatchesDelimited(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	// Names containing characters that sort before "/" ("-" and "."), so a directory's keys don't sort together with
+	// the keys following the directory name in a flat listing.
+	newBackends := func() (*memoryBackend, *memoryBackend) {
+		backend1 := newMemoryBackend("bucket1")
+		backend2 := newMemoryBackend("bucket2")
+
+		for _, key := range []string{"a-b", "a.txt", "a/b", "a/c/d", "a/c/e", "b/x", "b/y/z", "c"} {
+			backend1.put(key, "1", modified)
+		}
+
+		for i := 0; i < 10; i++ {
+			backend1.put(fmt.Sprintf("many/%02d/k", i), "1", modified)
+			backend2.put(fmt.Sprintf("many/%02d/k", i), "1", modified)
+		}
+
+		for _, key := range []string{"a-b", "a.txt/x", "a/b", "a/c/e", "b/y/z", "c/d", "d"} {
+			backend2.put(key, "1", modified)
+		}
+
+		backend2.put("a/c/d", "2", modified)
+		backend1.pageSize = 2
+		backend2.pageSize = 2
+
+		return backend1, backend2
+	}
+
+	var outputs [2]string
+	var calls [2]uint64
+
+	for i, flat := range []bool{false, true} {
+		backend1, backend2 := newBackends()
+		output := &bytes.Buffer{}
+		s3c := NewS3Comparer(context.Background(), output, OutputFormatText, backend1, backend2)
+
+		if flat {
+			s3c.FlatListing()
+		}
+
+		summary := s3c.ComparePrefixes("", "")
+		calls[i] = summary.Calls1 + summary.Calls2
+
+		// Reports of different directories are printed in a different order.
+		lines := strings.Split(output.String(), "\n")
+		sort.Strings(lines)
+		outputs[i] = strings.Join(lines, "\n")
+	}
+
+	if outputs[0] != outputs[1] {
+		t.Errorf("expected the same reports with and without -flat; got:\n%s\nand:\n%s", outputs[0], outputs[1])
+	}
+
+	for _, expected := range []string{
+		"Only in mem://bucket1/: a.txt", "Only in mem://bucket2/: a.txt/", "--- mem://bucket1/a/c/d",
+		"Only in mem://bucket1/b/: x", "Only in mem://bucket1/: c", "Only in mem://bucket2/: c/",
+		"Only in mem://bucket2/: d",
+	} {
+		if !strings.Contains(outputs[0], expected) {
+			t.Errorf("expected output to contain %#v; got:\n%s", expected, outputs[0])
+		}
+	}
+
+	if calls[1] >= calls[0] {
+		t.Errorf("expected fewer calls with -flat; got %d, and %d without", calls[1], calls[0])
+	}
+}
+
+func TestListStreamMapCollisions(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend := newMemoryBackend("bucket1")
+
+	for _, key := range []string{"a", "a.gz", "b.gz", "c.bz2", "c.gz"} {
+		backend.put(key, "1", modified)
+	}
+
+	rule, err := parseKeyMapRule(`s/\.(gz|bz2)$//`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s3c := NewS3Comparer(context.Background(), &bytes.Buffer{}, OutputFormatText, backend, newMemoryBackend("bucket2"))
+	stream := newListStream(s3c.handler1, "", false, true, nil, "")
+	stream.mapNames(&keyMapper{rules: []*keyMapRule{rule}}, "")
+	defer stream.close()
+
+	// Keys mapped to a listed key, or to the same key as another, keep their listed names and can't be mapped.
+	expected := []string{"a", "a.gz (error)", "b (b.gz)", "c.bz2 (error)", "c.gz (error)"}
+	var entries []string
+
+	for {
+		if _, ok := stream.peek(); !ok {
+			break
+		}
+
+		entry := stream.next()
+		description := entry.name
+
+		switch {
+		case entry.mapErr != nil:
+			description += " (error)"
+		case entry.listedName != entry.name:
+			description += " (" + entry.listedName + ")"
+		}
+
+		entries = append(entries, description)
+	}
+
+	if strings.Join(entries, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("expected %#v; got %#v", expected, entries)
+	}
+}
@@ -0,0 +1,450 @@
+package s3compare
+
+import (
+	"context"
+	"crypto/md5"  //nolint:gosec // Used to compute S3-compatible ETags, not for security.
+	"crypto/sha1" //nolint:gosec // Matches the S3 checksum algorithm.
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const defaultContentType = "binary/octet-stream"
+
+// localPageSize is the maximum number of files returned in each page of a recursive listing.
+const localPageSize = 1000
+
+// LocalBackend is a Backend for files in a local directory tree. Keys are slash-separated paths relative to the root
+// directory. Symlinks to files are followed, but symlinks to directories are skipped, since they may form loops.
+type LocalBackend struct {
+	root         string
+	checksums    bool
+	fileMetadata bool
+
+	// containsFilesCache records whether each directory searched by containsFiles contains files, so each is searched
+	// at most once however deeply it is nested.
+	containsFilesMutex sync.Mutex
+	containsFilesCache map[string]bool
+}
+
+func NewLocalBackend(root string) *LocalBackend {
+	return &LocalBackend{root: root, containsFilesCache: make(map[string]bool)}
+}
+
+func (lb *LocalBackend) URL(key string) string {
+	return fileURLPrefix + filepath.ToSlash(lb.root) + "/" + key
+}
+
+func (lb *LocalBackend) NewListPaginator(prefix string, recursive bool, startAfter string) ListPaginator {
+	if recursive {
+		return &localWalkPaginator{backend: lb, prefix: prefix, startAfter: startAfter}
+	}
+
+	return &localListPaginator{backend: lb, prefix: prefix, startAfter: startAfter}
+}
+
+// EnableChecksums causes StatObject to compute CRC32, CRC32C, SHA-1, and SHA-256 checksums of each file.
+func (lb *LocalBackend) EnableChecksums() {
+	lb.checksums = true
+}
+
+// EnableFileMetadata causes StatObject to report the permissions, owner, and group of each file as
+// x-amz-meta-file-* metadata. Ordinary uploads don't record these, and the owner and group IDs differ between hosts, so
+// they aren't reported unless enabled.
+func (lb *LocalBackend) EnableFileMetadata() {
+	lb.fileMetadata = true
+}
+
+// StatObject returns the attributes of the file at key. Local files have no versions, so versionID is ignored.
+func (lb *LocalBackend) StatObject(ctx context.Context, key, _ string) (*ObjectInfo, error) {
+	path := lb.path(key)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: not a regular file", path)
+	}
+
+	etag, checksums, err := lb.digest(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]string{
+		"content-length": fmt.Sprintf("%d", fi.Size()),
+		"content-type":   localContentType(path),
+		"etag":           etag,
+	}
+
+	if lb.fileMetadata {
+		for name, value := range localFileMetadata(fi) {
+			headers["x-amz-meta-"+name] = value
+		}
+	}
+
+	return &ObjectInfo{
+		LastModified: fi.ModTime().UTC(),
+		Headers:      headers,
+		Checksums:    checksums,
+	}, nil
+}
+
+func (lb *LocalBackend) OpenObject(ctx context.Context, key, _ string) (io.ReadCloser, error) {
+	f, err := os.Open(lb.path(key))
+	if err != nil {
+		return nil, err
+	}
+
+	return &contextReadCloser{ctx: ctx, ReadCloser: f}, nil
+}
+
+// path returns the local filesystem path for a key.
+func (lb *LocalBackend) path(key string) string {
+	return filepath.Join(lb.root, filepath.FromSlash(key))
+}
+
+// digest reads the file once, returning the ETag S3 would assign to the file if it were uploaded in a single part (the
+// quoted hex MD5 digest of the contents) and, if enabled, its checksums.
+func (lb *LocalBackend) digest(ctx context.Context, key string) (string, map[string]string, error) {
+	r, err := lb.OpenObject(ctx, key, "")
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+
+	etagHash := md5.New() //nolint:gosec // Used to compute S3-compatible ETags, not for security.
+	writers := []io.Writer{etagHash}
+	checksumHashes := make(map[string]hash.Hash)
+
+	if lb.checksums {
+		checksumHashes["crc32"] = crc32.NewIEEE()
+		checksumHashes["crc32c"] = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		checksumHashes["sha1"] = sha1.New() //nolint:gosec // Matches the S3 checksum algorithm.
+		checksumHashes["sha256"] = sha256.New()
+
+		for _, h := range checksumHashes {
+			writers = append(writers, h)
+		}
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return "", nil, err
+	}
+
+	checksums := make(map[string]string, len(checksumHashes))
+	for algorithm, h := range checksumHashes {
+		checksums[algorithm] = base64.StdEncoding.EncodeToString(h.Sum(nil))
+	}
+
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(etagHash.Sum(nil))), checksums, nil
+}
+
+// listDir returns the children of the directory dirPart (relative to the root) whose names begin with namePrefix.
+// Subdirectories are returned as subprefixes ending in "/", unless they contain no files: S3 has no empty prefixes, and
+// recursive listings wouldn't list them.
+func (lb *LocalBackend) listDir(ctx context.Context, dirPart, namePrefix string) (*ListPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	page := &ListPage{}
+
+	entries, err := os.ReadDir(lb.path(dirPart))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// S3 simply returns no results for a nonexistent prefix.
+			return page, nil
+		}
+
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), namePrefix) {
+			continue
+		}
+
+		fi, err := lb.statEntry(dirPart, entry)
+		if err != nil {
+			// Broken symlink or a file removed since ReadDir; skip it.
+			continue
+		}
+
+		switch {
+		case fi.IsDir():
+			if subprefix := dirPart + entry.Name() + "/"; lb.containsFiles(subprefix) {
+				page.Subprefixes = append(page.Subprefixes, subprefix)
+			}
+		case fi.Mode().IsRegular():
+			page.Objects = append(page.Objects, ListedObject{
+				Key:          dirPart + entry.Name(),
+				Size:         fi.Size(),
+				LastModified: fi.ModTime().UTC(),
+			})
+		}
+	}
+
+	sort.Strings(page.Subprefixes)
+	sort.Slice(page.Objects, func(i, j int) bool { return page.Objects[i].Key < page.Objects[j].Key })
+
+	return page, nil
+}
+
+// statEntry returns the attributes of an entry of the directory dir (relative to the root), following symlinks to
+// files. Symlinks to directories aren't followed; their own attributes are returned, so they are neither directories
+// nor regular files.
+func (lb *LocalBackend) statEntry(dir string, entry fs.DirEntry) (fs.FileInfo, error) {
+	fi, err := entry.Info()
+	if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+		return fi, err
+	}
+
+	target, err := os.Stat(lb.path(dir + entry.Name()))
+	if err != nil || target.IsDir() {
+		return fi, err
+	}
+
+	return target, nil
+}
+
+// containsFiles indicates whether the directory dir (relative to the root, ending in "/") contains a regular file at
+// any depth. The search stops at the first one. Searching a directory searches its subdirectories, which are searched
+// again when it is listed, so the result for each directory is cached. A directory that can't be read is assumed to
+// contain files, so the error is reported when it is listed.
+func (lb *LocalBackend) containsFiles(dir string) bool {
+	lb.containsFilesMutex.Lock()
+	found, cached := lb.containsFilesCache[dir]
+	lb.containsFilesMutex.Unlock()
+
+	if cached {
+		return found
+	}
+
+	found = lb.searchFiles(dir)
+
+	lb.containsFilesMutex.Lock()
+	lb.containsFilesCache[dir] = found
+	lb.containsFilesMutex.Unlock()
+
+	return found
+}
+
+// searchFiles searches the directory dir for a regular file at any depth, for containsFiles.
+func (lb *LocalBackend) searchFiles(dir string) bool {
+	entries, err := os.ReadDir(lb.path(dir))
+	if err != nil {
+		return true
+	}
+
+	for _, entry := range entries {
+		fi, err := lb.statEntry(dir, entry)
+		if err != nil {
+			continue
+		}
+
+		if fi.Mode().IsRegular() || fi.IsDir() && lb.containsFiles(dir+entry.Name()+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// localListPaginator lists a local directory in a single page.
+type localListPaginator struct {
+	backend    *LocalBackend
+	prefix     string
+	startAfter string
+	done       bool
+}
+
+func (llp *localListPaginator) HasMorePages() bool {
+	return !llp.done
+}
+
+func (llp *localListPaginator) NextPage(ctx context.Context) (*ListPage, error) {
+	if llp.done {
+		return nil, errors.New("no more pages available")
+	}
+
+	llp.done = true
+	dirPart, namePrefix := splitLocalPrefix(llp.prefix)
+
+	page, err := llp.backend.listDir(ctx, dirPart, namePrefix)
+	if err != nil || llp.startAfter == "" {
+		return page, err
+	}
+
+	result := &ListPage{}
+
+	for _, item := range sortedListItems(page) {
+		if item.name <= llp.startAfter {
+			continue
+		}
+
+		if item.object == nil {
+			result.Subprefixes = append(result.Subprefixes, item.name)
+		} else {
+			result.Objects = append(result.Objects, *item.object)
+		}
+	}
+
+	return result, nil
+}
+
+// localWalkPaginator lists every file under a prefix in key order, descending into directories as they are reached.
+// Only the directories on the path to the current file are held in memory.
+type localWalkPaginator struct {
+	backend    *LocalBackend
+	prefix     string
+	startAfter string
+	started    bool
+
+	// stack holds the unvisited entries of each directory being walked, innermost last.
+	stack [][]listItem
+}
+
+func (lwp *localWalkPaginator) HasMorePages() bool {
+	return !lwp.started || len(lwp.stack) > 0
+}
+
+func (lwp *localWalkPaginator) NextPage(ctx context.Context) (*ListPage, error) {
+	if !lwp.HasMorePages() {
+		return nil, errors.New("no more pages available")
+	}
+
+	if !lwp.started {
+		lwp.started = true
+
+		dirPart, namePrefix := splitLocalPrefix(lwp.prefix)
+		if err := lwp.push(ctx, dirPart, namePrefix); err != nil {
+			return nil, err
+		}
+	}
+
+	page := &ListPage{}
+
+	for len(lwp.stack) > 0 && len(page.Objects) < localPageSize {
+		top := len(lwp.stack) - 1
+		if len(lwp.stack[top]) == 0 {
+			lwp.stack = lwp.stack[:top]
+			continue
+		}
+
+		item := lwp.stack[top][0]
+		lwp.stack[top] = lwp.stack[top][1:]
+
+		switch {
+		case item.object != nil:
+			if item.name > lwp.startAfter {
+				page.Objects = append(page.Objects, *item.object)
+			}
+		case item.name > lwp.startAfter || strings.HasPrefix(lwp.startAfter, item.name):
+			// Only descend into directories that may hold keys following startAfter.
+			if err := lwp.push(ctx, item.name, ""); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return page, nil
+}
+
+// push starts walking the entries of a directory.
+func (lwp *localWalkPaginator) push(ctx context.Context, dirPart, namePrefix string) error {
+	page, err := lwp.backend.listDir(ctx, dirPart, namePrefix)
+	if err != nil {
+		return err
+	}
+
+	// Subdirectories are ordered by their names with a trailing "/", which places them where their keys would be in
+	// an S3 listing.
+	lwp.stack = append(lwp.stack, sortedListItems(page))
+
+	return nil
+}
+
+// splitLocalPrefix splits a prefix into the directory to read and the partial name to match within it.
+func splitLocalPrefix(prefix string) (dirPart, namePrefix string) {
+	if lastSlash := strings.LastIndex(prefix, "/"); lastSlash >= 0 {
+		return prefix[:lastSlash+1], prefix[lastSlash+1:]
+	}
+
+	return "", prefix
+}
+
+// localContentTypes maps lowercase file extensions to content types. A fixed table is used rather than the mime
+// package, which also reads the host's MIME tables, so the same tree compares the same way on every machine.
+var localContentTypes = map[string]string{
+	".avif":  "image/avif",
+	".bz2":   "application/x-bzip2",
+	".css":   "text/css",
+	".csv":   "text/csv",
+	".gif":   "image/gif",
+	".gz":    "application/gzip",
+	".htm":   "text/html",
+	".html":  "text/html",
+	".ico":   "image/vnd.microsoft.icon",
+	".jpeg":  "image/jpeg",
+	".jpg":   "image/jpeg",
+	".js":    "text/javascript",
+	".json":  "application/json",
+	".md":    "text/markdown",
+	".mjs":   "text/javascript",
+	".mp3":   "audio/mpeg",
+	".mp4":   "video/mp4",
+	".pdf":   "application/pdf",
+	".png":   "image/png",
+	".svg":   "image/svg+xml",
+	".tar":   "application/x-tar",
+	".tif":   "image/tiff",
+	".tiff":  "image/tiff",
+	".tsv":   "text/tab-separated-values",
+	".txt":   "text/plain",
+	".wasm":  "application/wasm",
+	".webm":  "video/webm",
+	".webp":  "image/webp",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".xml":   "text/xml",
+	".yaml":  "application/yaml",
+	".yml":   "application/yaml",
+	".zip":   "application/zip",
+}
+
+// localContentType guesses the content type from the file extension using localContentTypes.
+func localContentType(path string) string {
+	if contentType, found := localContentTypes[strings.ToLower(filepath.Ext(path))]; found {
+		return contentType
+	}
+
+	return defaultContentType
+}
+
+// contextReadCloser is an io.ReadCloser that stops reading once its context is cancelled.
+type contextReadCloser struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func (crc *contextReadCloser) Read(p []byte) (int, error) {
+	if err := crc.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return crc.ReadCloser.Read(p)
+}
@@ -0,0 +1,89 @@
+package s3compare
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLocalBackendFileMetadata(t *testing.T) {
+	root := writeTree(t, map[string]string{"a.txt": "hello"})
+
+	if err := os.Chmod(filepath.Join(root, "a.txt"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	lb := NewLocalBackend(root)
+
+	info, err := lb.StatObject(context.Background(), "a.txt", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for header := range info.Headers {
+		if strings.HasPrefix(header, "x-amz-meta-") {
+			t.Errorf("expected no metadata unless enabled; got %s", header)
+		}
+	}
+
+	if etag := info.Headers["etag"]; etag != `"5d41402abc4b2a76b9719d911017c592"` {
+		t.Errorf("expected the MD5 digest as the ETag; got %s", etag)
+	}
+
+	if contentType := info.Headers["content-type"]; contentType != "text/plain" {
+		t.Errorf("expected content-type text/plain; got %s", contentType)
+	}
+
+	lb.EnableFileMetadata()
+
+	info, err = lb.StatObject(context.Background(), "a.txt", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if permissions := info.Headers["x-amz-meta-file-permissions"]; permissions != "0640" {
+		t.Errorf("expected x-amz-meta-file-permissions 0640; got %#v", permissions)
+	}
+}
+
+func TestLocalBackendSkipsDirectorySymlinks(t *testing.T) {
+	root := writeTree(t, map[string]string{"a/b/c": "1", "d": "1"})
+
+	// A loop, a symlink to a file, and a symlink to a directory that holds files.
+	for link, target := range map[string]string{"a/b/loop": "..", "e": "d", "f": "a"} {
+		if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(link))); err != nil {
+			t.Skipf("cannot create symlinks: %v", err)
+		}
+	}
+
+	lb := NewLocalBackend(root)
+
+	var keys []string
+
+	for paginator := lb.NewListPaginator("", true, ""); paginator.HasMorePages(); {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, object := range page.Objects {
+			keys = append(keys, object.Key)
+		}
+	}
+
+	if expected := []string{"a/b/c", "d", "e"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %#v; got %#v", expected, keys)
+	}
+
+	page, err := lb.NewListPaginator("a/b/", false, "").NextPage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Subprefixes) != 0 || len(page.Objects) != 1 {
+		t.Errorf("expected only a/b/c; got %+v", page)
+	}
+}
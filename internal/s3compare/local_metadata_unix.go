@@ -0,0 +1,23 @@
+//go:build !windows
+
+package s3compare
+
+import (
+	"fmt"
+	"io/fs"
+	"syscall"
+)
+
+// localFileMetadata returns the x-amz-meta-* equivalents for a local file: its permissions, owner, and group.
+func localFileMetadata(fi fs.FileInfo) map[string]string {
+	metadata := map[string]string{
+		"file-permissions": fmt.Sprintf("%04o", fi.Mode().Perm()),
+	}
+
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		metadata["file-owner"] = fmt.Sprintf("%d", stat.Uid)
+		metadata["file-group"] = fmt.Sprintf("%d", stat.Gid)
+	}
+
+	return metadata
+}
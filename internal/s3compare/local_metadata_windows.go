@@ -0,0 +1,16 @@
+//go:build windows
+
+package s3compare
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// localFileMetadata returns the x-amz-meta-* equivalents for a local file. Windows has no numeric owner or group, so
+// only the permissions are reported.
+func localFileMetadata(fi fs.FileInfo) map[string]string {
+	return map[string]string{
+		"file-permissions": fmt.Sprintf("%04o", fi.Mode().Perm()),
+	}
+}
@@ -0,0 +1,273 @@
+package s3compare
+
+import (
+	"context"
+	"crypto/md5" //nolint:gosec // Used to compute S3-compatible ETags, not for security.
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryVersion is a version (or delete marker) of a key held by a memoryBackend.
+type memoryVersion struct {
+	id           string
+	contents     string
+	deleteMarker bool
+	lastModified time.Time
+	headers      map[string]string
+	tags         map[string]string
+	acl          *ObjectACL
+}
+
+// memoryBackend is a versioned Backend holding objects in memory, for tests. Listings are split into pages of
+// pageSize entries (versions, when listing versions), as S3 would split them, and every listing and StatObject call is
+// recorded.
+type memoryBackend struct {
+	name     string
+	pageSize int
+
+	mutex    sync.Mutex
+	versions map[string][]*memoryVersion // newest first
+
+	// listed records the subprefixes and keys returned by every page listed, and stats the keys examined by StatObject.
+	listed []string
+	stats  []string
+
+	// errors, if set, holds an error returned by StatObject for a key, or by the listing of a prefix.
+	errors map[string]error
+}
+
+func newMemoryBackend(name string) *memoryBackend {
+	return &memoryBackend{name: name, pageSize: 1000, versions: make(map[string][]*memoryVersion)}
+}
+
+// put adds a new version of key with the given contents, created at lastModified (which must follow its other
+// versions), returning it so attributes can be set.
+func (mb *memoryBackend) put(key, contents string, lastModified time.Time) *memoryVersion {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	version := &memoryVersion{
+		id:           fmt.Sprintf("v%d", len(mb.versions[key])+1),
+		contents:     contents,
+		lastModified: lastModified,
+		headers:      make(map[string]string),
+	}
+	mb.versions[key] = append([]*memoryVersion{version}, mb.versions[key]...)
+
+	return version
+}
+
+// remove adds a delete marker for key, created at lastModified.
+func (mb *memoryBackend) remove(key string, lastModified time.Time) {
+	mb.put(key, "", lastModified).deleteMarker = true
+}
+
+func (mb *memoryBackend) URL(key string) string {
+	return "mem://" + mb.name + "/" + key
+}
+
+func (mb *memoryBackend) NewListPaginator(prefix string, recursive bool, startAfter string) ListPaginator {
+	return mb.newPaginator(prefix, recursive, startAfter, false)
+}
+
+func (mb *memoryBackend) NewVersionListPaginator(prefix string, recursive bool, startAfter string) ListPaginator {
+	return mb.newPaginator(prefix, recursive, startAfter, true)
+}
+
+// newPaginator returns a paginator over a snapshot of the listing.
+func (mb *memoryBackend) newPaginator(prefix string, recursive bool, startAfter string, versions bool,
+) ListPaginator {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	keys := make([]string, 0, len(mb.versions))
+	for key := range mb.versions {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var items []listItem
+
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if slash := strings.Index(key[len(prefix):], "/"); !recursive && slash >= 0 {
+			subprefix := key[:len(prefix)+slash+1]
+			if subprefix > startAfter && (len(items) == 0 || items[len(items)-1].name != subprefix) {
+				items = append(items, listItem{name: subprefix})
+			}
+
+			continue
+		}
+
+		if key <= startAfter {
+			continue
+		}
+
+		for _, version := range mb.versions[key] {
+			if !versions && version.deleteMarker {
+				break
+			}
+
+			items = append(items, listItem{name: key, object: &ListedObject{
+				Key:            key,
+				VersionID:      version.id,
+				IsDeleteMarker: version.deleteMarker,
+				Size:           int64(len(version.contents)),
+				ETag:           memoryETag(version),
+				LastModified:   version.lastModified,
+			}})
+
+			if !versions {
+				break
+			}
+		}
+	}
+
+	return &memoryListPaginator{backend: mb, prefix: prefix, items: items}
+}
+
+func (mb *memoryBackend) StatObject(ctx context.Context, key, versionID string) (*ObjectInfo, error) {
+	version, err := mb.version(key, versionID)
+	if err != nil {
+		return nil, err
+	}
+
+	mb.mutex.Lock()
+	mb.stats = append(mb.stats, key)
+	mb.mutex.Unlock()
+
+	headers := copyHeaders(version.headers)
+	headers["content-length"] = fmt.Sprintf("%d", len(version.contents))
+	headers["etag"] = memoryETag(version)
+
+	return &ObjectInfo{LastModified: version.lastModified, Headers: headers}, nil
+}
+
+func (mb *memoryBackend) OpenObject(ctx context.Context, key, versionID string) (io.ReadCloser, error) {
+	version, err := mb.version(key, versionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(strings.NewReader(version.contents)), nil
+}
+
+func (mb *memoryBackend) ObjectTags(ctx context.Context, key, versionID string) (map[string]string, error) {
+	version, err := mb.version(key, versionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return version.tags, nil
+}
+
+func (mb *memoryBackend) ObjectACL(ctx context.Context, key, versionID string) (*ObjectACL, error) {
+	version, err := mb.version(key, versionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if version.acl == nil {
+		return &ObjectACL{}, nil
+	}
+
+	return version.acl, nil
+}
+
+// version returns the given version of key, or its latest version if versionID is empty.
+func (mb *memoryBackend) version(key, versionID string) (*memoryVersion, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	if err := mb.errors[key]; err != nil {
+		return nil, err
+	}
+
+	for _, version := range mb.versions[key] {
+		if versionID == "" && version.deleteMarker {
+			break
+		}
+
+		if versionID == "" || version.id == versionID {
+			return version, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s: no such key", mb.URL(key))
+}
+
+// listedNames returns the subprefixes and keys returned by the pages listed so far.
+func (mb *memoryBackend) listedNames() []string {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	return append([]string{}, mb.listed...)
+}
+
+// memoryETag returns the ETag S3 would assign to a version uploaded in a single part.
+func memoryETag(version *memoryVersion) string {
+	if version.deleteMarker {
+		return ""
+	}
+
+	digest := md5.Sum([]byte(version.contents)) //nolint:gosec // Used to compute S3-compatible ETags, not for security.
+
+	return "\"" + hex.EncodeToString(digest[:]) + "\""
+}
+
+// memoryListPaginator returns the items of a listing in pages.
+type memoryListPaginator struct {
+	backend *memoryBackend
+	prefix  string
+	items   []listItem
+	started bool
+}
+
+func (mlp *memoryListPaginator) HasMorePages() bool {
+	return !mlp.started || len(mlp.items) > 0
+}
+
+func (mlp *memoryListPaginator) NextPage(ctx context.Context) (*ListPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	mlp.backend.mutex.Lock()
+	defer mlp.backend.mutex.Unlock()
+
+	if err := mlp.backend.errors[mlp.prefix]; err != nil {
+		return nil, err
+	}
+
+	mlp.started = true
+
+	n := mlp.backend.pageSize
+	if n > len(mlp.items) {
+		n = len(mlp.items)
+	}
+
+	page := &ListPage{}
+
+	for _, item := range mlp.items[:n] {
+		if item.object == nil {
+			page.Subprefixes = append(page.Subprefixes, item.name)
+		} else {
+			page.Objects = append(page.Objects, *item.object)
+		}
+
+		mlp.backend.listed = append(mlp.backend.listed, item.name)
+	}
+
+	mlp.items = mlp.items[n:]
+
+	return page, nil
+}
@@ -0,0 +1,76 @@
+package s3compare
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// progressReporter periodically writes the progress of a comparison.
+type progressReporter struct {
+	output   io.Writer
+	interval time.Duration
+
+	// updateLine causes each report to overwrite the previous one on a terminal, instead of being written on a new line.
+	updateLine bool
+
+	// lastCalls and lastTime are the total number of calls made and the time as of the previous report, from which
+	// the call rate is estimated.
+	lastCalls uint64
+	lastTime  time.Time
+}
+
+// run writes a report each interval until stop is closed, then writes a final report and closes done.
+func (pr *progressReporter) run(s3c *S3Comparer, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(pr.interval)
+	defer ticker.Stop()
+
+	pr.lastTime = time.Now()
+
+	for {
+		select {
+		case <-ticker.C:
+			pr.report(s3c)
+
+		case <-stop:
+			pr.report(s3c)
+
+			if pr.updateLine {
+				fmt.Fprintln(pr.output)
+			}
+
+			return
+		}
+	}
+}
+
+// report writes the current progress: the counts so far, the calls in-flight to each location, and the rate at which
+// calls have been made since the previous report.
+func (pr *progressReporter) report(s3c *S3Comparer) {
+	summary := s3c.summary.snapshot()
+	calls := atomic.LoadUint64(&s3c.handler1.calls) + atomic.LoadUint64(&s3c.handler2.calls)
+	now := time.Now()
+
+	var rate float64
+	if elapsed := now.Sub(pr.lastTime).Seconds(); elapsed > 0 {
+		rate = float64(calls-pr.lastCalls) / elapsed
+	}
+
+	pr.lastCalls = calls
+	pr.lastTime = now
+
+	line := fmt.Sprintf("Progress: %d prefixes listed, %d keys compared, %d differences, %d errors, "+
+		"%d/%d calls in-flight, %.1f calls/s",
+		summary.Prefixes, summary.Compared, summary.OnlyIn1+summary.OnlyIn2+summary.Mismatched, summary.Errored,
+		atomic.LoadInt64(&s3c.handler1.inFlight), atomic.LoadInt64(&s3c.handler2.inFlight), rate)
+
+	if pr.updateLine {
+		// Return to the start of the line, and clear the rest of it after writing.
+		fmt.Fprintf(pr.output, "\r%s\x1b[K", line)
+	} else {
+		fmt.Fprintln(pr.output, line)
+	}
+}
@@ -0,0 +1,79 @@
+package s3compare
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressReport(t *testing.T) {
+	s3c := NewS3Comparer(context.Background(), &bytes.Buffer{}, OutputFormatText, newMemoryBackend("bucket1"),
+		newMemoryBackend("bucket2"))
+	s3c.summary.Prefixes = 3
+	s3c.summary.Compared = 7
+	s3c.summary.OnlyIn1 = 1
+	s3c.summary.Mismatched = 2
+	s3c.summary.Errored = 1
+	s3c.handler1.inFlight = 4
+	s3c.handler2.calls = 20
+
+	output := &bytes.Buffer{}
+	pr := &progressReporter{output: output, lastCalls: 10, lastTime: time.Now().Add(-time.Second)}
+	pr.report(s3c)
+
+	line := output.String()
+	prefix := "Progress: 3 prefixes listed, 7 keys compared, 3 differences, 1 errors, 4/0 calls in-flight, "
+
+	if !strings.HasPrefix(line, prefix) || !strings.HasSuffix(line, " calls/s\n") {
+		t.Errorf("expected a line beginning %#v; got %#v", prefix, line)
+	}
+
+	// Ten calls were made in about a second.
+	var rate float64
+	if _, err := fmt.Sscanf(line[len(prefix):], "%f calls/s", &rate); err != nil || rate < 5 || rate > 10 {
+		t.Errorf("expected about 10 calls/s; got %#v", line[len(prefix):])
+	}
+
+	if pr.lastCalls != 20 {
+		t.Errorf("expected the calls to be recorded for the next report; got %d", pr.lastCalls)
+	}
+
+	output.Reset()
+	pr.updateLine = true
+	pr.report(s3c)
+
+	if line := output.String(); !strings.HasPrefix(line, "\r"+prefix+"0.0 calls/s") || !strings.HasSuffix(line, "\x1b[K") {
+		t.Errorf("expected the line to be overwritten, with no new calls; got %#v", line)
+	}
+}
+
+func TestReportProgressFinal(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := newMemoryBackend("bucket2")
+
+	backend1.put("a", "1", modified)
+	backend2.put("a", "2", modified)
+
+	for _, updateLine := range []bool{false, true} {
+		progress := &bytes.Buffer{}
+		s3c := NewS3Comparer(context.Background(), &bytes.Buffer{}, OutputFormatText, backend1, backend2)
+
+		// The comparison finishes long before the first report, so only the final one is written.
+		s3c.ReportProgress(progress, time.Hour, updateLine)
+		s3c.ComparePrefixes("", "")
+
+		expected := "Progress: 1 prefixes listed, 1 keys compared, 1 differences, 0 errors, 0/0 calls in-flight"
+		if updateLine {
+			expected = "\r" + expected
+		}
+
+		if report := progress.String(); !strings.HasPrefix(report, expected) || strings.Count(report, "\n") != 1 ||
+			!strings.HasSuffix(report, "\n") {
+			t.Errorf("updateLine=%v: expected a final report beginning %#v; got %#v", updateLine, expected, report)
+		}
+	}
+}
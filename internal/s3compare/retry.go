@@ -0,0 +1,229 @@
+package s3compare
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"golang.org/x/sync/semaphore"
+)
+
+// DefaultMaxRetries and DefaultRetryDelay are the default number of times a failed call is retried, and the base delay
+// before retrying it (which doubles on each attempt, up to maxRetryDelay).
+const (
+	DefaultMaxRetries = 5
+	DefaultRetryDelay = 200 * time.Millisecond
+)
+
+const maxRetryDelay = 20 * time.Second
+
+// throttlingErrorCodes are the error codes S3 (and S3-compatible systems) return when requests are being throttled.
+var throttlingErrorCodes = map[string]bool{
+	"SlowDown":                 true,
+	"Throttling":               true,
+	"ThrottlingException":      true,
+	"RequestLimitExceeded":     true,
+	"RequestThrottled":         true,
+	"TooManyRequestsException": true,
+	"BandwidthLimitExceeded":   true,
+}
+
+// transientErrorCodes are the error codes, other than throttling, for failures that may succeed if retried.
+var transientErrorCodes = map[string]bool{
+	"InternalError":  true,
+	"RequestTimeout": true,
+}
+
+// isThrottlingError indicates whether an error is a response to requests being made too quickly.
+func isThrottlingError(err error) bool {
+	var apiErr interface{ ErrorCode() string }
+	if errors.As(err, &apiErr) && throttlingErrorCodes[apiErr.ErrorCode()] {
+		return true
+	}
+
+	var httpErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &httpErr) {
+		code := httpErr.HTTPStatusCode()
+		return code == http.StatusServiceUnavailable || code == http.StatusTooManyRequests
+	}
+
+	return false
+}
+
+// isRetryableError indicates whether a failed call may succeed if retried: if it was throttled, failed due to a server
+// error, or lost its connection (including a response cut short). The SDK's retries are disabled, so these are the
+// connection errors it would have retried. Calls that failed because the comparison was cancelled are not retried.
+func isRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if isThrottlingError(err) {
+		return true
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) ||
+		(retry.RetryableConnectionError{}).IsErrorRetryable(err) == aws.TrueTernary {
+		return true
+	}
+
+	var apiErr interface{ ErrorCode() string }
+	if errors.As(err, &apiErr) && transientErrorCodes[apiErr.ErrorCode()] {
+		return true
+	}
+
+	var httpErr interface{ HTTPStatusCode() int }
+
+	return errors.As(err, &httpErr) && httpErr.HTTPStatusCode() >= http.StatusInternalServerError
+}
+
+// errorCode returns the error code of an error returned by the service, or the HTTP status code if there is none, or ""
+// if the error didn't come from the service.
+func errorCode(err error) string {
+	var apiErr interface{ ErrorCode() string }
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() != "" {
+		return apiErr.ErrorCode()
+	}
+
+	var httpErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &httpErr) {
+		return strconv.Itoa(httpErr.HTTPStatusCode())
+	}
+
+	return ""
+}
+
+// errorMessage returns the message of an error returned by the service, or the text of the error if there is none.
+func errorMessage(err error) string {
+	var apiErr interface{ ErrorMessage() string }
+	if errors.As(err, &apiErr) && apiErr.ErrorMessage() != "" {
+		return apiErr.ErrorMessage()
+	}
+
+	return err.Error()
+}
+
+// retryDelay returns a random delay before retrying a call that has failed attempt+1 times: up to delay doubled for
+// each previous attempt, capped at maxRetryDelay ("full jitter"), so calls throttled together don't retry together.
+func retryDelay(delay time.Duration, attempt int) time.Duration {
+	for i := 0; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(delay))) //nolint:gosec // Used for jitter, not for security.
+}
+
+// adaptiveConcurrency limits the number of calls in-flight, adjusting the limit in response to throttling: it is
+// halved when a call is throttled, and increased by one after as many successful calls as the limit, up to the maximum
+// given. Decreases are made by acquiring ("withholding") slots of a semaphore, and increases by releasing them.
+type adaptiveConcurrency struct {
+	ctx context.Context
+	sem *semaphore.Weighted
+
+	mutex sync.Mutex
+
+	// limit is the current limit. The remaining slots (up to max) are withheld, or waiting to be withheld.
+	limit    int64
+	withheld int64
+
+	// successes counts the successful calls since the limit last changed.
+	successes int64
+
+	// generation is incremented each time the limit is decreased. A throttled call started before the last decrease
+	// doesn't cause another; the calls throttled together count once.
+	generation uint64
+}
+
+func newAdaptiveConcurrency(ctx context.Context, maxConcurrency int64) *adaptiveConcurrency {
+	return &adaptiveConcurrency{
+		ctx:   ctx,
+		sem:   semaphore.NewWeighted(maxConcurrency),
+		limit: maxConcurrency,
+	}
+}
+
+// acquire waits until a call can be made, returning the generation in which it was started. It must be followed by
+// release.
+func (ac *adaptiveConcurrency) acquire() (uint64, error) {
+	if err := ac.sem.Acquire(ac.ctx, 1); err != nil {
+		return 0, err
+	}
+
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	return ac.generation, nil
+}
+
+// release indicates that a call started in the given generation has finished, adjusting the limit if it succeeded or
+// was throttled.
+func (ac *adaptiveConcurrency) release(generation uint64, err error) {
+	ac.sem.Release(1)
+
+	switch {
+	case err == nil:
+		ac.increase()
+	case isThrottlingError(err):
+		ac.decrease(generation)
+	}
+}
+
+func (ac *adaptiveConcurrency) increase() {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	if ac.withheld == 0 {
+		return
+	}
+
+	ac.successes++
+	if ac.successes < ac.limit {
+		return
+	}
+
+	ac.successes = 0
+	ac.withheld--
+	ac.limit++
+	ac.sem.Release(1)
+}
+
+func (ac *adaptiveConcurrency) decrease(generation uint64) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	if generation != ac.generation || ac.limit <= 1 {
+		return
+	}
+
+	withhold := ac.limit - ac.limit/2
+	ac.limit -= withhold
+	ac.successes = 0
+	ac.generation++
+
+	// Wait for the calls in-flight over the new limit to finish in the background. Waiting calls are queued behind
+	// this, so the new limit takes effect immediately.
+	go func() {
+		if err := ac.sem.Acquire(ac.ctx, withhold); err != nil {
+			return
+		}
+
+		ac.mutex.Lock()
+		ac.withheld += withhold
+		ac.mutex.Unlock()
+	}()
+}
@@ -0,0 +1,178 @@
+package s3compare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testAPIError is an error returned by the service with the given code.
+type testAPIError struct {
+	code string
+}
+
+func (e *testAPIError) Error() string     { return e.code }
+func (e *testAPIError) ErrorCode() string { return e.code }
+
+// testHTTPError is an error from a response with the given status code.
+type testHTTPError struct {
+	status int
+}
+
+func (e *testHTTPError) Error() string       { return fmt.Sprintf("status %d", e.status) }
+func (e *testHTTPError) HTTPStatusCode() int { return e.status }
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		err        error
+		throttling bool
+		retryable  bool
+	}{
+		{err: &testAPIError{code: "SlowDown"}, throttling: true, retryable: true},
+		{err: fmt.Errorf("wrapped: %w", &testAPIError{code: "Throttling"}), throttling: true, retryable: true},
+		{err: &testAPIError{code: "InternalError"}, retryable: true},
+		{err: &testAPIError{code: "NoSuchKey"}},
+		{err: &testHTTPError{status: 503}, throttling: true, retryable: true},
+		{err: &testHTTPError{status: 429}, throttling: true, retryable: true},
+		{err: &testHTTPError{status: 500}, retryable: true},
+		{err: &testHTTPError{status: 403}},
+		{err: errors.New("connection refused")},
+		{err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, retryable: true},
+		{err: fmt.Errorf("reading body: %w", io.ErrUnexpectedEOF), retryable: true},
+		{err: &url.Error{Op: "Get", URL: "https://x/", Err: context.Canceled}},
+		{err: context.DeadlineExceeded},
+	}
+
+	for _, test := range tests {
+		if throttling := isThrottlingError(test.err); throttling != test.throttling {
+			t.Errorf("isThrottlingError(%v): got %v; expected %v", test.err, throttling, test.throttling)
+		}
+
+		if retryable := isRetryableError(test.err); retryable != test.retryable {
+			t.Errorf("isRetryableError(%v): got %v; expected %v", test.err, retryable, test.retryable)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	if delay := retryDelay(0, 3); delay != 0 {
+		t.Errorf("retryDelay(0, 3): got %v; expected 0", delay)
+	}
+
+	for attempt := 0; attempt < 12; attempt++ {
+		limit := DefaultRetryDelay << attempt
+		if limit > maxRetryDelay {
+			limit = maxRetryDelay
+		}
+
+		for i := 0; i < 100; i++ {
+			if delay := retryDelay(DefaultRetryDelay, attempt); delay < 0 || delay >= limit {
+				t.Fatalf("retryDelay(%v, %d): got %v; expected less than %v", DefaultRetryDelay, attempt, delay, limit)
+			}
+		}
+	}
+}
+
+// waitForWithheld waits for the slots withheld by a decrease of the limit to be acquired.
+func waitForWithheld(t *testing.T, ac *adaptiveConcurrency, withheld int64) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		ac.mutex.Lock()
+		current := ac.withheld
+		ac.mutex.Unlock()
+
+		if current == withheld {
+			return
+		}
+	}
+
+	t.Fatalf("expected %d slots to be withheld", withheld)
+}
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	ac := newAdaptiveConcurrency(context.Background(), 4)
+	throttled := &testAPIError{code: "SlowDown"}
+
+	generation1, err := ac.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generation2, err := ac.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Calls throttled together halve the limit once.
+	ac.release(generation1, throttled)
+	ac.release(generation2, throttled)
+	waitForWithheld(t, ac, 2)
+
+	if ac.limit != 2 {
+		t.Fatalf("expected a limit of 2 after throttling; got %d", ac.limit)
+	}
+
+	if ac.sem.TryAcquire(3) {
+		t.Fatal("expected no more than 2 calls to be allowed after throttling")
+	}
+
+	// The limit is increased by one after as many successful calls as the limit.
+	for i, expected := range []int64{2, 3, 3, 3, 4, 4, 4, 4, 4} {
+		generation, err := ac.acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ac.release(generation, nil)
+
+		if ac.limit != expected {
+			t.Fatalf("expected a limit of %d after %d successful calls; got %d", expected, i+1, ac.limit)
+		}
+	}
+
+	if ac.withheld != 0 || !ac.sem.TryAcquire(4) {
+		t.Fatalf("expected the full limit of 4 calls to be restored; %d slots withheld", ac.withheld)
+	}
+}
+
+func TestCallRetriesConnectionErrors(t *testing.T) {
+	connErrs := []error{
+		&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET},
+		fmt.Errorf("operation error S3: GetObject, %w", io.ErrUnexpectedEOF),
+		&url.Error{Op: "Get", URL: "https://bucket.s3.amazonaws.com/a", Err: &net.OpError{Op: "dial", Net: "tcp",
+			Err: errors.New("no such host")}},
+	}
+
+	ctx := context.Background()
+
+	for _, connErr := range connErrs {
+		handler := &asyncS3Handler{ctx: ctx, concurrency: newAdaptiveConcurrency(ctx, 4), maxRetries: 2}
+		attempts := 0
+
+		err := handler.call(func() error {
+			attempts++
+			if attempts == 1 {
+				return connErr
+			}
+
+			return nil
+		})
+
+		if err != nil || attempts != 2 {
+			t.Errorf("%v: expected the call to succeed on the second attempt; got %v after %d attempts", connErr, err,
+				attempts)
+		}
+
+		// A dropped connection isn't a sign of throttling.
+		if handler.concurrency.limit != 4 {
+			t.Errorf("%v: expected the limit to stay at 4; got %d", connErr, handler.concurrency.limit)
+		}
+	}
+}
@@ -2,107 +2,422 @@ package s3compare
 
 import (
 	"context"
+	"crypto/md5" //nolint:gosec // Used to compute S3-compatible ETags, not for security.
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"sort"
+	"hash"
+	"io"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 )
 
 type asyncS3Handler struct {
-	ctx    context.Context
-	sem    *semaphore.Weighted
-	s3     S3APIClient
-	bucket string
+	ctx         context.Context
+	concurrency *adaptiveConcurrency
+	backend     Backend
+
+	// maxRetries is the number of times a call that fails with a throttling or server error, or loses its connection,
+	// is retried, after a random delay of up to retryDelay, doubled for each attempt.
+	maxRetries int
+	retryDelay time.Duration
+
+	// limiter, if not nil, limits the rate at which calls are made.
+	limiter *rate.Limiter
+
+	// asOf, if not zero, is the point in time at which the backend is examined.
+	asOf time.Time
+
+	// shardChars, if not empty, holds the characters (in order) at which listings are split into shards.
+	shardChars string
+
+	// calls counts the calls made, including retries, and inFlight the calls in progress.
+	calls    uint64
+	inFlight int64
 }
 
-type asyncListPrefixResult struct {
-	Subprefixes []string
-	Keys        []string
-	Err         error
+// url returns the URL of the given key in this handler's backend.
+func (s3ah *asyncS3Handler) url(key string) string {
+	return s3ah.backend.URL(key)
 }
 
-func (s3ah *asyncS3Handler) asyncListPrefix(prefix string, doneChan chan<- *asyncListPrefixResult) {
-	defer close(doneChan)
+// setAsOf sets the point in time at which the backend is examined.
+func (s3ah *asyncS3Handler) setAsOf(asOf time.Time) error {
+	if _, ok := s3ah.backend.(VersionBackend); !ok {
+		return fmt.Errorf("%s: backend cannot list versions", s3ah.url(""))
+	}
+
+	s3ah.asOf = asOf
+
+	return nil
+}
+
+// setRateLimit limits the calls made to rps per second.
+func (s3ah *asyncS3Handler) setRateLimit(rps float64) {
+	s3ah.limiter = rate.NewLimiter(rate.Limit(rps), 1)
+}
+
+// call makes a call to the backend using fn once the rate limit (if any) allows it and one of the calls in-flight
+// allowed by the concurrency limit is available. The rate limit is waited on first, so calls waiting on it don't hold
+// slots that calls to the other location (if it shares the concurrency limit) could use. If the call is throttled,
+// fails with a server error, or loses its connection, it is retried after a random, exponentially increasing delay, up
+// to maxRetries times. The error from the last attempt is returned.
+func (s3ah *asyncS3Handler) call(fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		if s3ah.limiter != nil {
+			if err := s3ah.limiter.Wait(s3ah.ctx); err != nil {
+				return err
+			}
+		}
+
+		generation, err := s3ah.concurrency.acquire()
+		if err != nil {
+			return err
+		}
 
-	result := asyncListPrefixResult{
-		Subprefixes: make([]string, 0, 20),
-		Keys:        make([]string, 0, 20),
+		atomic.AddUint64(&s3ah.calls, 1)
+		atomic.AddInt64(&s3ah.inFlight, 1)
+		err = fn()
+		atomic.AddInt64(&s3ah.inFlight, -1)
+		s3ah.concurrency.release(generation, err)
+
+		if err == nil || attempt >= s3ah.maxRetries || !isRetryableError(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(retryDelay(s3ah.retryDelay, attempt)):
+		case <-s3ah.ctx.Done():
+			return err
+		}
 	}
-	params := &s3.ListObjectsV2Input{
-		Bucket:    &s3ah.bucket,
-		Delimiter: aws.String("/"),
-		Prefix:    &prefix,
+}
+
+type asyncListPageResult struct {
+	Page *ListPage
+	Err  error
+}
+
+// asyncListPages lists the children of prefix as described by newListPaginator, sending each page with the prefix
+// removed as soon as it is received. The next page is not requested until the previous one is accepted, so only a
+// page or two is held in memory. Listing stops early if stop is closed.
+//
+// If shard characters are set and the listing doesn't fit in one page, the rest of it is listed in parallel shards.
+func (s3ah *asyncS3Handler) asyncListPages(prefix string, versions, recursive bool, stop <-chan struct{},
+	pageChan chan<- *asyncListPageResult) {
+	defer close(pageChan)
+
+	paginator, err := s3ah.newListPaginator(prefix, versions, recursive, "")
+	if err != nil {
+		s3ah.sendPage(pageChan, stop, &asyncListPageResult{Err: err})
+		return
 	}
 
-	paginator := s3.NewListObjectsV2Paginator(s3ah.s3, params)
 	for paginator.HasMorePages() {
-		if s3ah.ctx.Err() != nil {
+		page, err := s3ah.nextPage(prefix, paginator)
+
+		var last string
+		if page != nil {
+			last = prefix + lastListed(page)
+		}
+
+		if !s3ah.sendPage(pageChan, stop, &asyncListPageResult{Page: page, Err: err}) {
 			return
 		}
 
-		if err := s3ah.sem.Acquire(s3ah.ctx, 1); err != nil {
-			doneChan <- &asyncListPrefixResult{Err: err}
+		if s3ah.shardChars != "" && paginator.HasMorePages() {
+			s3ah.listShards(prefix, versions, recursive, paginator, last, stop, pageChan)
 			return
 		}
+	}
+}
 
-		loo, err := paginator.NextPage(s3ah.ctx)
-		s3ah.sem.Release(1)
+// sendPage sends a page of a listing, returning false if the listing should stop: because the page is an error, or
+// because stop was closed.
+func (s3ah *asyncS3Handler) sendPage(pageChan chan<- *asyncListPageResult, stop <-chan struct{},
+	result *asyncListPageResult) bool {
+	select {
+	case pageChan <- result:
+		return result.Err == nil
+	case <-stop:
+		return false
+	case <-s3ah.ctx.Done():
+		return false
+	}
+}
 
-		if err != nil {
-			doneChan <- &asyncListPrefixResult{Err: err}
-			return
+// newListPaginator returns a paginator over the children of prefix (or, if recursive is set, every key under prefix)
+// following startAfter. If versions is set, every version and delete marker of each key is listed. If the handler has
+// a point in time set, the listing is of the versions current at that time.
+func (s3ah *asyncS3Handler) newListPaginator(prefix string, versions, recursive bool, startAfter string,
+) (ListPaginator, error) {
+	if !versions && s3ah.asOf.IsZero() {
+		return s3ah.backend.NewListPaginator(prefix, recursive, startAfter), nil
+	}
+
+	versionBackend, ok := s3ah.backend.(VersionBackend)
+	if !ok {
+		return nil, fmt.Errorf("%s: backend cannot list versions", s3ah.url(prefix))
+	}
+
+	if s3ah.asOf.IsZero() {
+		return versionBackend.NewVersionListPaginator(prefix, recursive, startAfter), nil
+	}
+
+	return newAsOfListPaginator(versionBackend, prefix, recursive, startAfter, s3ah.asOf, versions, s3ah.call), nil
+}
+
+// selfCallingListPaginator is implemented by paginators that may make calls of their own for a page (such as
+// asOfListPaginator), and by wrappers that may hold one.
+type selfCallingListPaginator interface {
+	ListPaginator
+
+	// makesOwnCalls indicates whether the paginator makes its calls through asyncS3Handler.call itself, in which case
+	// its pages must not be fetched within a call.
+	makesOwnCalls() bool
+}
+
+// nextPage fetches the next page of a listing of prefix, removing the prefix from each subprefix and key.
+func (s3ah *asyncS3Handler) nextPage(prefix string, paginator ListPaginator) (*ListPage, error) {
+	var page *ListPage
+
+	fetch := func() (err error) {
+		page, err = paginator.NextPage(s3ah.ctx)
+		return err
+	}
+
+	var err error
+
+	if selfCalling, ok := paginator.(selfCallingListPaginator); ok && selfCalling.makesOwnCalls() {
+		// The paginator makes each of its calls through s3ah.call itself, as it may make several for a page. Making
+		// them within another call would hold two of the calls in-flight allowed at once, and count twice against the
+		// rate limit and retries.
+		err = fetch()
+	} else {
+		err = s3ah.call(fetch)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, subprefix := range page.Subprefixes {
+		if !strings.HasPrefix(subprefix, prefix) {
+			panic(fmt.Sprintf(
+				"Expected listing of %s to have common prefixes beginning with %s; got CommonPrefix %s",
+				s3ah.url(prefix), prefix, subprefix))
 		}
 
-		for _, commonPrefix := range loo.CommonPrefixes {
-			commonPrefixStr := aws.ToString(commonPrefix.Prefix)
-			if !strings.HasPrefix(commonPrefixStr, prefix) {
-				panic(fmt.Sprintf(
-					"Expected ListObjects on s3://%s/%s to have common prefixes beginning with %s; got CommonPrefix %s",
-					s3ah.bucket, prefix, prefix, commonPrefixStr))
-			}
+		page.Subprefixes[i] = subprefix[len(prefix):]
+	}
 
-			result.Subprefixes = append(result.Subprefixes, commonPrefixStr[len(prefix):])
+	for i := range page.Objects {
+		obj := &page.Objects[i]
+		if !strings.HasPrefix(obj.Key, prefix) {
+			panic(fmt.Sprintf(
+				"Expected listing of %s to have keys beginning with %s; got Key %s",
+				s3ah.url(prefix), prefix, obj.Key))
 		}
 
-		for i := range loo.Contents {
-			obj := &loo.Contents[i]
-			key := aws.ToString(obj.Key)
+		obj.Key = obj.Key[len(prefix):]
+	}
+
+	return page, nil
+}
+
+type asyncHeadObjectResult struct {
+	Result *ObjectInfo
+	Err    error
+}
 
-			if !strings.HasPrefix(key, prefix) {
-				panic(fmt.Sprintf(
-					"Expected ListObjects on s3://%s/%s to have keys beginning with %s; got Key %s",
-					s3ah.bucket, prefix, prefix, key))
+func (s3ah *asyncS3Handler) asyncHeadObject(key, versionID string, resultChan chan<- *asyncHeadObjectResult) {
+	defer close(resultChan)
+
+	var info *ObjectInfo
+
+	err := s3ah.call(func() (err error) {
+		info, err = s3ah.backend.StatObject(s3ah.ctx, key, versionID)
+		return err
+	})
+	resultChan <- &asyncHeadObjectResult{Result: info, Err: err}
+}
+
+type asyncExtraHeadersResult struct {
+	Headers map[string]string
+
+	// Operation is the call that failed, if Err is set.
+	Operation string
+	Err       error
+}
+
+// asyncExtraHeaders fetches the object attributes that require separate calls (tags and/or ACLs) and sends them as
+// pseudo-headers. Canonical user IDs in the ACL are mapped using aclIDMap.
+func (s3ah *asyncS3Handler) asyncExtraHeaders(key, versionID string, tags, acls bool, aclIDMap map[string]string,
+	resultChan chan<- *asyncExtraHeadersResult) {
+	defer close(resultChan)
+
+	headers := make(map[string]string)
+
+	if tags {
+		tagBackend, ok := s3ah.backend.(TagBackend)
+		if !ok {
+			resultChan <- &asyncExtraHeadersResult{
+				Operation: operationGetObjectTagging,
+				Err:       fmt.Errorf("%s: backend cannot report tags", s3ah.url(key)),
 			}
+			return
+		}
 
-			result.Keys = append(result.Keys, key[len(prefix):])
+		var objectTags map[string]string
+
+		err := s3ah.call(func() (err error) {
+			objectTags, err = tagBackend.ObjectTags(s3ah.ctx, key, versionID)
+			return err
+		})
+		if err != nil {
+			resultChan <- &asyncExtraHeadersResult{Operation: operationGetObjectTagging, Err: err}
+			return
 		}
+
+		addTagHeaders(headers, objectTags)
 	}
 
-	sort.Strings(result.Subprefixes)
-	sort.Strings(result.Keys)
+	if acls {
+		aclBackend, ok := s3ah.backend.(ACLBackend)
+		if !ok {
+			resultChan <- &asyncExtraHeadersResult{
+				Operation: operationGetObjectACL,
+				Err:       fmt.Errorf("%s: backend cannot report ACLs", s3ah.url(key)),
+			}
+			return
+		}
+
+		var acl *ObjectACL
+
+		err := s3ah.call(func() (err error) {
+			acl, err = aclBackend.ObjectACL(s3ah.ctx, key, versionID)
+			return err
+		})
+		if err != nil {
+			resultChan <- &asyncExtraHeadersResult{Operation: operationGetObjectACL, Err: err}
+			return
+		}
 
-	doneChan <- &result
+		addACLHeaders(headers, acl, aclIDMap)
+	}
+
+	resultChan <- &asyncExtraHeadersResult{Headers: headers}
 }
 
-type asyncHeadObjectResult struct {
-	Result *s3.HeadObjectOutput
+type asyncHashObjectResult struct {
+	Digest []byte
 	Err    error
 }
 
-func (s3ah *asyncS3Handler) asyncHeadObject(key string, resultChan chan<- *asyncHeadObjectResult) {
+// asyncHashObject reads the object (or version) at key and sends the digest of its contents. The download counts as a
+// single call in-flight for its duration; if it is retried, it starts over.
+func (s3ah *asyncS3Handler) asyncHashObject(key, versionID string, newHash func() hash.Hash,
+	resultChan chan<- *asyncHashObjectResult) {
 	defer close(resultChan)
 
-	if err := s3ah.sem.Acquire(s3ah.ctx, 1); err != nil {
-		resultChan <- &asyncHeadObjectResult{Err: err}
-
+	contentBackend, ok := s3ah.backend.(ContentBackend)
+	if !ok {
+		resultChan <- &asyncHashObjectResult{Err: fmt.Errorf("%s: backend cannot read object contents", s3ah.url(key))}
 		return
 	}
 
-	hoi := &s3.HeadObjectInput{Bucket: &s3ah.bucket, Key: &key}
-	hoo, err := s3ah.s3.HeadObject(s3ah.ctx, hoi)
-	s3ah.sem.Release(1)
-	resultChan <- &asyncHeadObjectResult{Result: hoo, Err: err}
+	var digest []byte
+
+	err := s3ah.call(func() error {
+		body, err := contentBackend.OpenObject(s3ah.ctx, key, versionID)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		h := newHash()
+		if _, err := io.Copy(h, body); err != nil {
+			return err
+		}
+
+		digest = h.Sum(nil)
+
+		return nil
+	})
+	resultChan <- &asyncHashObjectResult{Digest: digest, Err: err}
+}
+
+// partLayout returns the part size and count of the object (or version) at key.
+func (s3ah *asyncS3Handler) partLayout(key, versionID string) (int64, int, error) {
+	partBackend, ok := s3ah.backend.(PartBackend)
+	if !ok {
+		return 0, 0, fmt.Errorf("%s: backend cannot report multipart layouts", s3ah.url(key))
+	}
+
+	var partSize int64
+	var partCount int
+
+	err := s3ah.call(func() (err error) {
+		partSize, partCount, err = partBackend.PartLayout(s3ah.ctx, key, versionID)
+		return err
+	})
+
+	return partSize, partCount, err
+}
+
+// multipartETag reads the object (or version) at key and returns the ETag S3 would assign to it if it were uploaded in
+// parts of partSize bytes: the MD5 digest of the concatenated MD5 digests of each part, followed by the number of
+// parts.
+func (s3ah *asyncS3Handler) multipartETag(key, versionID string, partSize int64) (string, error) {
+	contentBackend, ok := s3ah.backend.(ContentBackend)
+	if !ok {
+		return "", fmt.Errorf("%s: backend cannot read object contents", s3ah.url(key))
+	}
+
+	var etag string
+
+	err := s3ah.call(func() error {
+		body, err := contentBackend.OpenObject(s3ah.ctx, key, versionID)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		etag, err = computeMultipartETag(body, partSize)
+
+		return err
+	})
+
+	return etag, err
+}
+
+// computeMultipartETag returns the multipart ETag of the contents of r uploaded in parts of partSize bytes.
+func computeMultipartETag(r io.Reader, partSize int64) (string, error) {
+	var partDigests []byte
+	partCount := 0
+
+	for {
+		h := md5.New() //nolint:gosec // Used to compute S3-compatible ETags, not for security.
+		n, err := io.CopyN(h, r, partSize)
+
+		if n > 0 {
+			partDigests = append(partDigests, h.Sum(nil)...)
+			partCount++
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	etag := md5.Sum(partDigests) //nolint:gosec // Used to compute S3-compatible ETags, not for security.
+
+	return fmt.Sprintf("\"%s-%d\"", hex.EncodeToString(etag[:]), partCount), nil
 }
@@ -0,0 +1,148 @@
+package s3compare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestComputeMultipartETag(t *testing.T) {
+	tests := []struct {
+		contents string
+		partSize int64
+		expected string
+	}{
+		{contents: "hello world", partSize: 5, expected: `"df349a9519959b17a605009540f4b31d-3"`},
+		{contents: "abcdef", partSize: 3, expected: `"4c8e93283780e078db9e0c6b9b3f8043-2"`},
+		{contents: "abc", partSize: 10, expected: `"af5da9f45af7a300e3aded972f8ff687-1"`},
+	}
+
+	for _, test := range tests {
+		etag, err := computeMultipartETag(strings.NewReader(test.contents), test.partSize)
+		if err != nil {
+			t.Errorf("computeMultipartETag(%#v, %d): unexpected error %v", test.contents, test.partSize, err)
+			continue
+		}
+
+		if etag != test.expected {
+			t.Errorf("computeMultipartETag(%#v, %d): got %s; expected %s", test.contents, test.partSize, etag,
+				test.expected)
+		}
+	}
+
+	readErr := errors.New("read failed")
+	if _, err := computeMultipartETag(iotest.ErrReader(readErr), 5); !errors.Is(err, readErr) {
+		t.Errorf("expected the read error; got %v", err)
+	}
+}
+
+func TestRateLimitSharedBucket(t *testing.T) {
+	root := t.TempDir()
+
+	// Both locations in the same directory share one limit, at the lower rate.
+	s3c := NewS3Comparer(context.Background(), &strings.Builder{}, OutputFormatText, NewLocalBackend(root),
+		NewLocalBackend(root))
+	s3c.RateLimit1(10)
+	s3c.RateLimit2(5)
+
+	if s3c.handler1.limiter != s3c.handler2.limiter {
+		t.Fatal("expected locations in the same bucket to share a rate limiter")
+	}
+
+	if limit := s3c.handler1.limiter.Limit(); limit != 5 {
+		t.Errorf("expected a shared limit of 5 calls/s; got %v", limit)
+	}
+
+	s3c.RateLimit1(20)
+
+	if limit := s3c.handler2.limiter.Limit(); limit != 5 {
+		t.Errorf("expected the lower limit of 5 calls/s to be kept; got %v", limit)
+	}
+
+	// Other locations are limited separately.
+	s3c = NewS3Comparer(context.Background(), &strings.Builder{}, OutputFormatText, NewLocalBackend(root),
+		NewLocalBackend(t.TempDir()))
+	s3c.RateLimit1(10)
+
+	if s3c.handler1.limiter == nil || s3c.handler2.limiter != nil {
+		t.Error("expected only the first location to be rate limited")
+	}
+}
+
+func TestRateLimitedCallHoldsNoSlot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The locations share a single call in-flight; the first has used up its rate limit for the next hour.
+	concurrency := newAdaptiveConcurrency(ctx, 1)
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	limiter.Allow()
+
+	handler1 := &asyncS3Handler{ctx: ctx, concurrency: concurrency, limiter: limiter}
+	handler2 := &asyncS3Handler{ctx: ctx, concurrency: concurrency}
+
+	waiting := make(chan error, 1)
+
+	go func() {
+		waiting <- handler1.call(func() error { return nil })
+	}()
+
+	// Give the first call time to start waiting.
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- handler2.call(func() error { return nil })
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a call waiting on the rate limit kept the other location from making calls")
+	}
+
+	cancel()
+
+	if err := <-waiting; err == nil {
+		t.Error("expected the rate-limited call to fail once cancelled")
+	}
+}
+
+func TestRateLimitAppliesToAllCalls(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := newMemoryBackend("bucket2")
+
+	for i := 0; i < 4; i++ {
+		backend1.put(fmt.Sprintf("d/%d", i), "1", modified)
+		backend2.put(fmt.Sprintf("d/%d", i), "1", modified)
+	}
+
+	const rps = 40
+
+	s3c := NewS3Comparer(context.Background(), &strings.Builder{}, OutputFormatText, backend1, backend2)
+	s3c.RateLimit1(rps)
+
+	started := time.Now()
+	summary := s3c.ComparePrefixes("", "")
+	elapsed := time.Since(started)
+
+	// Two listings and four HeadObject calls, of which only the first is made without waiting.
+	if summary.Calls1 != 6 {
+		t.Fatalf("expected 6 calls to the first location; got %d", summary.Calls1)
+	}
+
+	if minimum := time.Duration(summary.Calls1-1) * time.Second / rps; elapsed < minimum {
+		t.Errorf("expected %d calls at %d/s to take at least %v; took %v", summary.Calls1, rps, minimum, elapsed)
+	}
+}
@@ -0,0 +1,317 @@
+package s3compare
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type S3APIClient interface {
+	s3.HeadObjectAPIClient
+	s3.ListObjectsV2APIClient
+	GetObject(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	GetObjectTagging(context.Context, *s3.GetObjectTaggingInput, ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	GetObjectAcl(context.Context, *s3.GetObjectAclInput, ...func(*s3.Options)) (*s3.GetObjectAclOutput, error)
+	ListObjectVersions(context.Context, *s3.ListObjectVersionsInput, ...func(*s3.Options),
+	) (*s3.ListObjectVersionsOutput, error)
+}
+
+// S3Backend is a Backend for objects in an S3 bucket.
+type S3Backend struct {
+	client       S3APIClient
+	bucket       string
+	checksumMode bool
+}
+
+func NewS3Backend(client S3APIClient, bucket string) *S3Backend {
+	return &S3Backend{client: client, bucket: bucket}
+}
+
+func (s3b *S3Backend) URL(key string) string {
+	return s3URLPrefix + s3b.bucket + "/" + key
+}
+
+func (s3b *S3Backend) NewListPaginator(prefix string, recursive bool, startAfter string) ListPaginator {
+	params := &s3.ListObjectsV2Input{
+		Bucket:     &s3b.bucket,
+		Delimiter:  delimiter(recursive),
+		Prefix:     &prefix,
+		StartAfter: optionalString(startAfter),
+	}
+
+	return &s3ListPaginator{paginator: s3.NewListObjectsV2Paginator(s3b.client, params)}
+}
+
+// EnableChecksums requests additional checksums on HeadObject calls. This requires kms:Decrypt permission for objects
+// encrypted with SSE-KMS.
+func (s3b *S3Backend) EnableChecksums() {
+	s3b.checksumMode = true
+}
+
+// NewVersionListPaginator returns a paginator over object versions. The key marker is exclusive, so it serves as
+// startAfter.
+func (s3b *S3Backend) NewVersionListPaginator(prefix string, recursive bool, startAfter string) ListPaginator {
+	return &s3VersionListPaginator{
+		client: s3b.client,
+		params: s3.ListObjectVersionsInput{
+			Bucket:    &s3b.bucket,
+			Delimiter: delimiter(recursive),
+			KeyMarker: optionalString(startAfter),
+			Prefix:    &prefix,
+		},
+	}
+}
+
+func (s3b *S3Backend) StatObject(ctx context.Context, key, versionID string) (*ObjectInfo, error) {
+	hoi := &s3.HeadObjectInput{Bucket: &s3b.bucket, Key: &key, VersionId: optionalString(versionID)}
+	if s3b.checksumMode {
+		hoi.ChecksumMode = types.ChecksumModeEnabled
+	}
+
+	hoo, err := s3b.client.HeadObject(ctx, hoi)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{
+		LastModified: aws.ToTime(hoo.LastModified),
+		Headers:      headObjectOutputToHeaders(hoo),
+		Checksums:    headObjectOutputToChecksums(hoo),
+	}, nil
+}
+
+func (s3b *S3Backend) PartLayout(ctx context.Context, key, versionID string) (int64, int, error) {
+	hoo, err := s3b.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:     &s3b.bucket,
+		Key:        &key,
+		PartNumber: 1,
+		VersionId:  optionalString(versionID),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return hoo.ContentLength, int(hoo.PartsCount), nil
+}
+
+func (s3b *S3Backend) ObjectTags(ctx context.Context, key, versionID string) (map[string]string, error) {
+	gota, err := s3b.client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket:    &s3b.bucket,
+		Key:       &key,
+		VersionId: optionalString(versionID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string, len(gota.TagSet))
+	for _, tag := range gota.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+
+	return tags, nil
+}
+
+func (s3b *S3Backend) ObjectACL(ctx context.Context, key, versionID string) (*ObjectACL, error) {
+	goao, err := s3b.client.GetObjectAcl(ctx, &s3.GetObjectAclInput{
+		Bucket:    &s3b.bucket,
+		Key:       &key,
+		VersionId: optionalString(versionID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	acl := &ObjectACL{Grants: make([]ACLGrant, 0, len(goao.Grants))}
+	if goao.Owner != nil {
+		acl.Owner = aws.ToString(goao.Owner.ID)
+	}
+
+	for _, grant := range goao.Grants {
+		if grant.Grantee == nil {
+			continue
+		}
+
+		aclGrant := ACLGrant{Permission: string(grant.Permission)}
+
+		switch grant.Grantee.Type {
+		case types.TypeCanonicalUser:
+			aclGrant.GranteeType = "id"
+			aclGrant.Grantee = aws.ToString(grant.Grantee.ID)
+		case types.TypeGroup:
+			aclGrant.GranteeType = "uri"
+			aclGrant.Grantee = aws.ToString(grant.Grantee.URI)
+		case types.TypeAmazonCustomerByEmail:
+			aclGrant.GranteeType = "emailAddress"
+			aclGrant.Grantee = aws.ToString(grant.Grantee.EmailAddress)
+		default:
+			aclGrant.GranteeType = strings.ToLower(string(grant.Grantee.Type))
+			aclGrant.Grantee = aws.ToString(grant.Grantee.ID)
+		}
+
+		acl.Grants = append(acl.Grants, aclGrant)
+	}
+
+	return acl, nil
+}
+
+func (s3b *S3Backend) OpenObject(ctx context.Context, key, versionID string) (io.ReadCloser, error) {
+	goo, err := s3b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:    &s3b.bucket,
+		Key:       &key,
+		VersionId: optionalString(versionID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return goo.Body, nil
+}
+
+// delimiter returns the delimiter to use for a listing: none for a recursive listing, otherwise "/".
+func delimiter(recursive bool) *string {
+	if recursive {
+		return nil
+	}
+
+	return aws.String("/")
+}
+
+// s3ListPaginator adapts a ListObjectsV2Paginator to the ListPaginator interface.
+type s3ListPaginator struct {
+	paginator *s3.ListObjectsV2Paginator
+}
+
+func (s3lp *s3ListPaginator) HasMorePages() bool {
+	return s3lp.paginator.HasMorePages()
+}
+
+func (s3lp *s3ListPaginator) NextPage(ctx context.Context) (*ListPage, error) {
+	loo, err := s3lp.paginator.NextPage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &ListPage{
+		Subprefixes: make([]string, 0, len(loo.CommonPrefixes)),
+		Objects:     make([]ListedObject, 0, len(loo.Contents)),
+	}
+
+	for _, commonPrefix := range loo.CommonPrefixes {
+		page.Subprefixes = append(page.Subprefixes, aws.ToString(commonPrefix.Prefix))
+	}
+
+	for i := range loo.Contents {
+		obj := &loo.Contents[i]
+		page.Objects = append(page.Objects, ListedObject{
+			Key:          aws.ToString(obj.Key),
+			Size:         obj.Size,
+			ETag:         aws.ToString(obj.ETag),
+			StorageClass: string(obj.StorageClass),
+			LastModified: aws.ToTime(obj.LastModified),
+		})
+	}
+
+	return page, nil
+}
+
+// s3VersionListPaginator pages through ListObjectVersions results. The SDK doesn't provide a paginator for this.
+type s3VersionListPaginator struct {
+	client S3APIClient
+	params s3.ListObjectVersionsInput
+	done   bool
+}
+
+func (s3vlp *s3VersionListPaginator) HasMorePages() bool {
+	return !s3vlp.done
+}
+
+func (s3vlp *s3VersionListPaginator) NextPage(ctx context.Context) (*ListPage, error) {
+	if s3vlp.done {
+		return nil, errors.New("no more pages available")
+	}
+
+	lovo, err := s3vlp.client.ListObjectVersions(ctx, &s3vlp.params)
+	if err != nil {
+		return nil, err
+	}
+
+	if lovo.IsTruncated {
+		s3vlp.params.KeyMarker = lovo.NextKeyMarker
+		s3vlp.params.VersionIdMarker = lovo.NextVersionIdMarker
+	} else {
+		s3vlp.done = true
+	}
+
+	page := &ListPage{
+		Subprefixes: make([]string, 0, len(lovo.CommonPrefixes)),
+		Objects:     make([]ListedObject, 0, len(lovo.Versions)+len(lovo.DeleteMarkers)),
+	}
+
+	for _, commonPrefix := range lovo.CommonPrefixes {
+		page.Subprefixes = append(page.Subprefixes, aws.ToString(commonPrefix.Prefix))
+	}
+
+	// Versions and delete markers are returned separately; they're interleaved below, so whether each is the latest
+	// version of its key is kept alongside it.
+	type listedVersion struct {
+		object   ListedObject
+		isLatest bool
+	}
+
+	versions := make([]listedVersion, 0, len(lovo.Versions)+len(lovo.DeleteMarkers))
+
+	for i := range lovo.Versions {
+		version := &lovo.Versions[i]
+		versions = append(versions, listedVersion{
+			object: ListedObject{
+				Key:          aws.ToString(version.Key),
+				VersionID:    aws.ToString(version.VersionId),
+				Size:         version.Size,
+				ETag:         aws.ToString(version.ETag),
+				StorageClass: string(version.StorageClass),
+				LastModified: aws.ToTime(version.LastModified),
+			},
+			isLatest: version.IsLatest,
+		})
+	}
+
+	for i := range lovo.DeleteMarkers {
+		deleteMarker := &lovo.DeleteMarkers[i]
+		versions = append(versions, listedVersion{
+			object: ListedObject{
+				Key:            aws.ToString(deleteMarker.Key),
+				VersionID:      aws.ToString(deleteMarker.VersionId),
+				IsDeleteMarker: true,
+				LastModified:   aws.ToTime(deleteMarker.LastModified),
+			},
+			isLatest: deleteMarker.IsLatest,
+		})
+	}
+
+	// Interleave them by key, newest first. Times are only to the second, so a version and a delete marker created in
+	// the same second are ordered by which is the latest; older ones keep the order S3 returned them in.
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].object.Key != versions[j].object.Key {
+			return versions[i].object.Key < versions[j].object.Key
+		}
+
+		if !versions[i].object.LastModified.Equal(versions[j].object.LastModified) {
+			return versions[i].object.LastModified.After(versions[j].object.LastModified)
+		}
+
+		return versions[i].isLatest && !versions[j].isLatest
+	})
+
+	for i := range versions {
+		page.Objects = append(page.Objects, versions[i].object)
+	}
+
+	return page, nil
+}
@@ -0,0 +1,55 @@
+package s3compare
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// versionListClient is an S3APIClient returning a single page of object versions. Other calls aren't implemented.
+type versionListClient struct {
+	S3APIClient
+	output *s3.ListObjectVersionsOutput
+}
+
+func (vlc *versionListClient) ListObjectVersions(context.Context, *s3.ListObjectVersionsInput, ...func(*s3.Options),
+) (*s3.ListObjectVersionsOutput, error) {
+	return vlc.output, nil
+}
+
+func TestVersionListOrdersLatestFirst(t *testing.T) {
+	// Times are only to the second, so a key deleted (or restored) in the second it was written has a version and a
+	// delete marker with the same time.
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	client := &versionListClient{output: &s3.ListObjectVersionsOutput{
+		Versions: []types.ObjectVersion{
+			{Key: aws.String("deleted"), VersionId: aws.String("v1"), LastModified: aws.Time(modified)},
+			{Key: aws.String("restored"), VersionId: aws.String("v3"), LastModified: aws.Time(modified), IsLatest: true},
+			{Key: aws.String("restored"), VersionId: aws.String("v1"), LastModified: aws.Time(modified.Add(-time.Hour))},
+		},
+		DeleteMarkers: []types.DeleteMarkerEntry{
+			{Key: aws.String("deleted"), VersionId: aws.String("v2"), LastModified: aws.Time(modified), IsLatest: true},
+			{Key: aws.String("restored"), VersionId: aws.String("v2"), LastModified: aws.Time(modified)},
+		},
+	}}
+
+	page, err := NewS3Backend(client, "bucket").NewVersionListPaginator("", true, "").NextPage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var versions []string
+	for _, object := range page.Objects {
+		versions = append(versions, object.Key+" "+object.VersionID)
+	}
+
+	expected := []string{"deleted v2", "deleted v1", "restored v3", "restored v2", "restored v1"}
+	if !reflect.DeepEqual(versions, expected) {
+		t.Errorf("expected %#v; got %#v", expected, versions)
+	}
+}
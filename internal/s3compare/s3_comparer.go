@@ -1,27 +1,43 @@
 package s3compare
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"os"
 	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"golang.org/x/sync/semaphore"
 )
 
 const defaultConcurrency int64 = 20
 
-type S3APIClient interface {
-	s3.HeadObjectAPIClient
-	s3.ListObjectsV2APIClient
-}
+// maxPendingKeys and maxPendingPrefixes limit the number of key comparisons and prefix listings in progress (or
+// waiting on S3 calls), so memory use doesn't grow with the size of the trees being compared.
+const (
+	maxPendingKeys     int64 = 1000
+	maxPendingPrefixes int64 = 100
+)
+
+// Operations reported in errors, named for the S3 API calls made (or their equivalents for other backends).
+const (
+	operationListObjects      = "ListObjects"
+	operationHeadObject       = "HeadObject"
+	operationGetObject        = "GetObject"
+	operationGetObjectTagging = "GetObjectTagging"
+	operationGetObjectACL     = "GetObjectAcl"
+
+	// operationMapKey is reported for keys that can't be mapped to a key in the second location.
+	operationMapKey = "MapKey"
+)
 
 type S3Comparer struct {
 	ctx              context.Context
@@ -33,69 +49,396 @@ type S3Comparer struct {
 	firstJSONWritten uint32
 	handler1         *asyncS3Handler
 	handler2         *asyncS3Handler
+	contentHashName  string
+	newContentHash   func() hash.Hash
+	compareChecksums bool
+	multipartETags   bool
+	compareTags      bool
+	compareACLs      bool
+	aclIDMap         map[string]string
+	compareVersions  bool
+	flatListing      bool
+	listOnly         bool
+	compareHeaders   map[string]bool
+	filter           *keyFilter
+	keyMapper        *keyMapper
+	rootPrefix1      string
+	rootPrefix2      string
+	pendingKeys      *semaphore.Weighted
+	pendingPrefixes  *semaphore.Weighted
+	printSummary     bool
+	heldReports      []*DiffReport
+	progress         *progressReporter
+	started          time.Time
+
+	// summary holds the counts of the comparison so far. Its MismatchedHeaders and EquivalentHeaders are guarded by
+	// summaryMutex; the other counts are updated atomically.
+	summary      Summary
+	summaryMutex sync.Mutex
 }
 
-func NewS3Comparer(ctx context.Context, output io.Writer, outputFormat OutputFormat,
-	s3Client1 S3APIClient, s3Client2 S3APIClient, bucket1, bucket2 string) *S3Comparer {
-	sem1 := semaphore.NewWeighted(defaultConcurrency)
-	var sem2 *semaphore.Weighted
+func NewS3Comparer(ctx context.Context, output io.Writer, outputFormat OutputFormat, backend1, backend2 Backend,
+) *S3Comparer {
+	concurrency1 := newAdaptiveConcurrency(ctx, defaultConcurrency)
+	var concurrency2 *adaptiveConcurrency
 
-	if bucket1 == bucket2 {
-		// Use the same sempahore if we're using the same bucket
-		sem2 = sem1
+	if backend1.URL("") == backend2.URL("") {
+		// Use the same limit if we're using the same bucket
+		concurrency2 = concurrency1
 	} else {
-		// Otherwise create a unique sempahore.
-		sem2 = semaphore.NewWeighted(defaultConcurrency)
+		// Otherwise create a unique limit.
+		concurrency2 = newAdaptiveConcurrency(ctx, defaultConcurrency)
 	}
 
 	return &S3Comparer{
-		ctx:            ctx,
-		wg:             &sync.WaitGroup{},
-		ignoredHeaders: make(map[string]bool),
-		output:         output,
-		outputFormat:   outputFormat,
+		ctx:             ctx,
+		wg:              &sync.WaitGroup{},
+		ignoredHeaders:  make(map[string]bool),
+		aclIDMap:        make(map[string]string),
+		compareHeaders:  make(map[string]bool),
+		output:          output,
+		outputFormat:    outputFormat,
+		pendingKeys:     semaphore.NewWeighted(maxPendingKeys),
+		pendingPrefixes: semaphore.NewWeighted(maxPendingPrefixes),
+		summary:         Summary{MismatchedHeaders: make(map[string]uint64)},
 		handler1: &asyncS3Handler{
-			ctx:    ctx,
-			sem:    sem1,
-			s3:     s3Client1,
-			bucket: bucket1,
+			ctx:         ctx,
+			concurrency: concurrency1,
+			backend:     backend1,
+			maxRetries:  DefaultMaxRetries,
+			retryDelay:  DefaultRetryDelay,
 		},
 		handler2: &asyncS3Handler{
-			ctx:    ctx,
-			sem:    sem2,
-			s3:     s3Client2,
-			bucket: bucket2,
+			ctx:         ctx,
+			concurrency: concurrency2,
+			backend:     backend2,
+			maxRetries:  DefaultMaxRetries,
+			retryDelay:  DefaultRetryDelay,
 		},
 	}
 }
 
 func (s3c *S3Comparer) IgnoreHeader(header string) {
-	s3c.ignoredHeaders[strings.ToLower(header)] = true
+	s3c.ignoredHeaders[canonicalHeaderName(header)] = true
+}
+
+// CompareContent enables downloading both objects and comparing digests of their contents using the named hash
+// algorithm. Content differences are reported separately as ContentMismatch. Since the ETag is only a proxy for the
+// contents, ETag differences alone are not reported as mismatches in this mode.
+func (s3c *S3Comparer) CompareContent(hashName string) error {
+	newHash, err := getContentHash(hashName)
+	if err != nil {
+		return err
+	}
+
+	s3c.contentHashName = hashName
+	s3c.newContentHash = newHash
+
+	return nil
+}
+
+// CompareChecksums enables comparing full-object checksums (x-amz-checksum-*) when both objects have one using the
+// same algorithm. In that case, the ETag is not compared; otherwise, comparison falls back to the ETag.
+func (s3c *S3Comparer) CompareChecksums() {
+	s3c.compareChecksums = true
+
+	for _, handler := range []*asyncS3Handler{s3c.handler1, s3c.handler2} {
+		if checksumBackend, ok := handler.backend.(ChecksumBackend); ok {
+			checksumBackend.EnableChecksums()
+		}
+	}
+}
+
+// CompareTags enables comparing object tags, which are reported as x-amz-tag-* headers. Both backends must be able to
+// report tags.
+func (s3c *S3Comparer) CompareTags() error {
+	for _, handler := range []*asyncS3Handler{s3c.handler1, s3c.handler2} {
+		if _, ok := handler.backend.(TagBackend); !ok {
+			return fmt.Errorf("%s: backend cannot report tags", handler.url(""))
+		}
+	}
+
+	s3c.compareTags = true
+
+	return nil
+}
+
+// CompareACLs enables comparing object owners and ACL grants, which are reported as x-amz-owner and
+// x-amz-grant-<permission> headers. Both backends must be able to report ACLs.
+func (s3c *S3Comparer) CompareACLs() error {
+	for _, handler := range []*asyncS3Handler{s3c.handler1, s3c.handler2} {
+		if _, ok := handler.backend.(ACLBackend); !ok {
+			return fmt.Errorf("%s: backend cannot report ACLs", handler.url(""))
+		}
+	}
+
+	s3c.compareACLs = true
+
+	return nil
+}
+
+// MapACLID causes the canonical user ID id1 in ACLs from the first location to be treated as id2, so that objects
+// copied across accounts can be compared.
+func (s3c *S3Comparer) MapACLID(id1, id2 string) {
+	s3c.aclIDMap[id1] = id2
+}
+
+// CompareVersions enables comparing the version history of each key: the sequence of versions (by size and ETag) and
+// delete markers, from oldest to newest. Differences are reported as VersionMismatch. Keys with only delete markers in
+// one location and absent from the other are reported as DeleteMarker rather than Missing. Both backends must keep
+// version histories.
+func (s3c *S3Comparer) CompareVersions() error {
+	for _, handler := range []*asyncS3Handler{s3c.handler1, s3c.handler2} {
+		if _, ok := handler.backend.(VersionBackend); !ok {
+			return fmt.Errorf("%s: backend cannot list versions", handler.url(""))
+		}
+	}
+
+	s3c.compareVersions = true
+
+	return nil
+}
+
+// AsOf1 causes the first location to be compared as it was at the given time: each key's version current at that
+// time is compared, and keys deleted (or not yet created) at that time are absent. The backend must keep version
+// histories.
+func (s3c *S3Comparer) AsOf1(asOf time.Time) error {
+	return s3c.handler1.setAsOf(asOf)
+}
+
+// AsOf2 causes the second location to be compared as it was at the given time, as with AsOf1.
+func (s3c *S3Comparer) AsOf2(asOf time.Time) error {
+	return s3c.handler2.setAsOf(asOf)
+}
+
+// FlatListing causes each location to be listed without a delimiter, and the two listings to be merged as pages
+// arrive, instead of listing each subprefix separately. This takes far fewer requests for trees with many small
+// directories. The differences reported are the same.
+func (s3c *S3Comparer) FlatListing() {
+	s3c.flatListing = true
+}
+
+// ShardListings causes listings that don't fit in a single page to be split into key ranges, which are listed in
+// parallel. The ranges are split at each of the given characters following the prefix being listed, so chars should
+// cover the characters keys commonly begin with (such as "0123456789abcdef" for hex-named keys). It may not contain
+// "/".
+func (s3c *S3Comparer) ShardListings(chars string) error {
+	if chars == "" {
+		return errors.New("no shard characters given")
+	}
+
+	if strings.Contains(chars, "/") {
+		return errors.New("shard characters may not include \"/\"")
+	}
+
+	s3c.handler1.shardChars = sortedShardChars(chars)
+	s3c.handler2.shardChars = s3c.handler1.shardChars
+
+	return nil
+}
+
+// ListOnly enables quick comparison using listing data alone: the size, ETag, and storage class. Objects are only
+// examined with HeadObject (and compared as usual) if their listings differ, or if other headers, checksums, tags,
+// ACLs, or contents are to be compared. Differences in other headers of objects that list the same are not found.
+func (s3c *S3Comparer) ListOnly() {
+	s3c.listOnly = true
+}
+
+// CompareHeader requests that the given header always be compared. With ListOnly, this means every object is examined
+// with HeadObject; otherwise, all headers are compared anyway.
+func (s3c *S3Comparer) CompareHeader(header string) {
+	s3c.compareHeaders[canonicalHeaderName(header)] = true
 }
 
+// Include restricts the comparison to keys matching the given pattern, or in directories matching it. It may be given
+// more than once to include keys matching any of the patterns. Patterns match key paths relative to the prefixes
+// being compared; they are globs (in which "**" matches across directories) unless they begin with "re:", in which
+// case they are regular expressions. See newPathPattern for details.
+func (s3c *S3Comparer) Include(pattern string) error {
+	pp, err := newPathPattern(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid include pattern %#v: %w", pattern, err)
+	}
+
+	if s3c.filter == nil {
+		s3c.filter = &keyFilter{}
+	}
+
+	s3c.filter.includes = append(s3c.filter.includes, pp)
+
+	return nil
+}
+
+// Exclude skips keys matching the given pattern, or in directories matching it, as with Include. Excluded directories
+// are not listed (unless the listing is flat).
+func (s3c *S3Comparer) Exclude(pattern string) error {
+	pp, err := newPathPattern(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid exclude pattern %#v: %w", pattern, err)
+	}
+
+	if s3c.filter == nil {
+		s3c.filter = &keyFilter{}
+	}
+
+	s3c.filter.excludes = append(s3c.filter.excludes, pp)
+
+	return nil
+}
+
+// MapKey adds a rule mapping keys in the first location to the keys expected in the second location, for trees whose
+// keys are renamed when copied. The rule is a substitution, s/regex/replacement/ (or s/regex/replacement/g to replace
+// every match), applied to the key path relative to the prefix being compared; rules are applied in the order they
+// are added. Directories are mapped with their trailing "/", and their contents are then compared with the mapped
+// directory. Rules that move keys to another directory, or merge a directory into another one that is listed, require a
+// flat listing: otherwise, the keys and subprefixes they move can't be mapped, and are reported as errors (if the
+// filter selects them) and compared with their unmapped keys. Keys mapped to the same key as another one are also
+// reported as errors and compared unmapped. Other rules give the same differences whether or not the listing is flat.
+//
+// Each listing of the first location is read in full and sorted by the mapped keys before being compared, so memory
+// use grows with the size of the largest listing: of a directory, or of every key under the prefix if the listing is
+// flat.
+func (s3c *S3Comparer) MapKey(rule string) error {
+	kmr, err := parseKeyMapRule(rule)
+	if err != nil {
+		return fmt.Errorf("invalid key mapping %#v: %w", rule, err)
+	}
+
+	if s3c.keyMapper == nil {
+		s3c.keyMapper = &keyMapper{}
+	}
+
+	s3c.keyMapper.rules = append(s3c.keyMapper.rules, kmr)
+
+	return nil
+}
+
+// MultipartETags enables checking whether objects with differing ETags, at least one of which was uploaded in multiple
+// parts, are equivalent. The other object is read and its multipart ETag is recomputed using the part layout of the
+// multipart object; if they match, the ETags are reported as equivalent rather than different, and counted in
+// Summary.EquivalentHeaders.
+func (s3c *S3Comparer) MultipartETags() {
+	s3c.multipartETags = true
+}
+
+// Concurrency sets the maximum number of calls in-flight to each location. If calls are throttled, the limit is reduced
+// (and gradually restored once calls succeed).
 func (s3c *S3Comparer) Concurrency(concurrency uint) {
-	sem1 := semaphore.NewWeighted(int64(concurrency))
-	var sem2 *semaphore.Weighted
+	concurrency1 := newAdaptiveConcurrency(s3c.ctx, int64(concurrency))
+	var concurrency2 *adaptiveConcurrency
 
-	if s3c.handler1.bucket == s3c.handler2.bucket {
-		// Use the same sempahore if we're using the same bucket
-		sem2 = sem1
+	if s3c.sharesBucket() {
+		// Use the same limit if we're using the same bucket
+		concurrency2 = concurrency1
 	} else {
-		// Otherwise create a unique sempahore.
-		sem2 = semaphore.NewWeighted(int64(concurrency))
+		// Otherwise create a unique limit.
+		concurrency2 = newAdaptiveConcurrency(s3c.ctx, int64(concurrency))
 	}
 
-	s3c.handler1.sem = sem1
-	s3c.handler2.sem = sem2
+	s3c.handler1.concurrency = concurrency1
+	s3c.handler2.concurrency = concurrency2
 }
 
-func (s3c *S3Comparer) ComparePrefixes(prefix1, prefix2 string) {
-	s3c.wg.Add(1)
+// Retries sets the number of times a call that is throttled, fails with a server error, or loses its connection is
+// retried, and the base delay before retrying it. Each retry waits a random time of up to the delay, doubled for each
+// previous attempt (up to 20 seconds).
+func (s3c *S3Comparer) Retries(maxRetries int, delay time.Duration) {
+	for _, handler := range []*asyncS3Handler{s3c.handler1, s3c.handler2} {
+		handler.maxRetries = maxRetries
+		handler.retryDelay = delay
+	}
+}
+
+// RateLimit1 limits the S3 calls (listings, HeadObject, and others) made to the first location to rps per second, in
+// addition to the limit on calls in-flight set by Concurrency. If both locations are in the same bucket, the limit is
+// shared by the calls made to both, as the limit on calls in-flight is; the lower of the rates given is used.
+func (s3c *S3Comparer) RateLimit1(rps float64) {
+	s3c.setRateLimit(s3c.handler1, rps)
+}
 
-	go s3c.asyncComparePrefixes(prefix1, prefix2)
+// RateLimit2 limits the S3 calls made to the second location to rps per second, as with RateLimit1.
+func (s3c *S3Comparer) RateLimit2(rps float64) {
+	s3c.setRateLimit(s3c.handler2, rps)
+}
+
+// setRateLimit limits the calls made through handler to rps per second, or if both locations are in the same bucket,
+// the calls made through either handler to the lowest rate given.
+func (s3c *S3Comparer) setRateLimit(handler *asyncS3Handler, rps float64) {
+	if !s3c.sharesBucket() {
+		handler.setRateLimit(rps)
+		return
+	}
+
+	if limiter := s3c.handler1.limiter; limiter != nil && float64(limiter.Limit()) <= rps {
+		return
+	}
+
+	s3c.handler1.setRateLimit(rps)
+	s3c.handler2.limiter = s3c.handler1.limiter
+}
+
+// sharesBucket indicates whether both locations are in the same bucket (or local directory), and so share limits on
+// the calls made to them.
+func (s3c *S3Comparer) sharesBucket() bool {
+	return s3c.handler1.url("") == s3c.handler2.url("")
+}
+
+// PrintSummary causes a summary of the comparison to be written at the end of the output: as lines beginning with
+// "Summary:" for text output, or as a final element (or line, for NDJSON) of type Summary for JSON output. It isn't
+// written to CSV or TSV output, and is always included in HTML output.
+func (s3c *S3Comparer) PrintSummary() {
+	s3c.printSummary = true
+}
+
+// ReportProgress causes the progress of the comparison to be written to output every interval: the number of prefixes
+// listed, keys compared, and differences and errors found so far, the calls in-flight to each location, and the rate
+// at which calls are being made. If updateLine is set, each report overwrites the previous one (for terminals) instead
+// of being written on a new line.
+func (s3c *S3Comparer) ReportProgress(output io.Writer, interval time.Duration, updateLine bool) {
+	s3c.progress = &progressReporter{output: output, interval: interval, updateLine: updateLine}
+}
+
+// ComparePrefixes compares every key under prefix1 in the first location with the corresponding key under prefix2 in
+// the second location, reporting differences (and errors) to the output as they are found. It returns a summary of the
+// keys compared and the differences and errors reported.
+func (s3c *S3Comparer) ComparePrefixes(prefix1, prefix2 string) Summary {
+	s3c.started = time.Now()
+	s3c.rootPrefix1 = prefix1
+	s3c.rootPrefix2 = prefix2
+
+	if s3c.progress != nil {
+		stopProgress := make(chan struct{})
+		progressDone := make(chan struct{})
+
+		go s3c.progress.run(s3c, stopProgress, progressDone)
+
+		defer func() {
+			close(stopProgress)
+			<-progressDone
+		}()
+	}
+
+	if s3c.flatListing {
+		s3c.wg.Add(1)
+
+		go s3c.asyncCompareFlat(prefix1, prefix2)
+	} else {
+		s3c.startComparePrefixes(prefix1, prefix2)
+	}
 
 	s3c.wg.Wait()
 
+	summary := s3c.currentSummary()
+
+	switch {
+	case s3c.outputFormat == OutputFormatCSV || s3c.outputFormat == OutputFormatTSV:
+		_ = s3c.writeTable()
+	case s3c.outputFormat == OutputFormatHTML:
+		_ = s3c.writeHTML(&summary)
+	case s3c.printSummary:
+		_ = s3c.writeSummary(&summary)
+	}
+
 	if s3c.outputFormat == OutputFormatJSON {
 		// Close the JSON structure.
 		s3c.outputMutex.Lock()
@@ -110,171 +453,295 @@ func (s3c *S3Comparer) ComparePrefixes(prefix1, prefix2 string) {
 			_ = s3c.write([]byte("\n]"))
 		}
 	}
+
+	return summary
 }
 
-func (s3c *S3Comparer) asyncComparePrefixes(prefix1, prefix2 string) {
-	defer s3c.wg.Done()
+// currentSummary returns a copy of the summary of the comparison so far.
+func (s3c *S3Comparer) currentSummary() Summary {
+	summary := s3c.summary.snapshot()
+	summary.Calls1 = atomic.LoadUint64(&s3c.handler1.calls)
+	summary.Calls2 = atomic.LoadUint64(&s3c.handler2.calls)
+	summary.ElapsedSeconds = time.Since(s3c.started).Seconds()
+	summary.MismatchedHeaders = make(map[string]uint64)
 
-	resultChan1 := make(chan *asyncListPrefixResult)
-	resultChan2 := make(chan *asyncListPrefixResult)
+	s3c.summaryMutex.Lock()
+	defer s3c.summaryMutex.Unlock()
 
-	go s3c.handler1.asyncListPrefix(prefix1, resultChan1)
-	go s3c.handler2.asyncListPrefix(prefix2, resultChan2)
+	for header, count := range s3c.summary.MismatchedHeaders {
+		summary.MismatchedHeaders[header] = count
+	}
 
-	var err1 error
-	var err2 error
-	var subprefixes1 []string
-	var subprefixes2 []string
-	var keys1 []string
-	var keys2 []string
+	if len(s3c.summary.EquivalentHeaders) > 0 {
+		summary.EquivalentHeaders = make(map[string]uint64, len(s3c.summary.EquivalentHeaders))
 
-	for resultChan1 != nil || resultChan2 != nil {
-		select {
-		case result, ok := <-resultChan1:
-			if ok {
-				if result.Err != nil {
-					err1 = result.Err
-				} else {
-					subprefixes1 = result.Subprefixes
-					keys1 = result.Keys
-				}
-			} else {
-				resultChan1 = nil
-			}
+		for header, count := range s3c.summary.EquivalentHeaders {
+			summary.EquivalentHeaders[header] = count
+		}
+	}
 
-		case result, ok := <-resultChan2:
-			if ok {
-				if result.Err != nil {
-					err2 = result.Err
-				} else {
-					subprefixes2 = result.Subprefixes
-					keys2 = result.Keys
-				}
-			} else {
-				resultChan2 = nil
-			}
+	return summary
+}
 
-		case <-s3c.ctx.Done():
-			return
-		}
+// countMismatchedHeaders counts the headers that differed in a mismatch report.
+func (s3c *S3Comparer) countMismatchedHeaders(headers []string) {
+	s3c.summaryMutex.Lock()
+	defer s3c.summaryMutex.Unlock()
+
+	for _, header := range headers {
+		s3c.summary.MismatchedHeaders[header]++
+	}
+}
+
+// countEquivalentHeader counts a header that differed in a comparison but whose values were found to be equivalent.
+func (s3c *S3Comparer) countEquivalentHeader(header string) {
+	s3c.summaryMutex.Lock()
+	defer s3c.summaryMutex.Unlock()
+
+	if s3c.summary.EquivalentHeaders == nil {
+		s3c.summary.EquivalentHeaders = make(map[string]uint64)
 	}
 
-	if err1 != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read from s3://%s/%s: %v\n", s3c.handler1.bucket, prefix1, err1)
+	s3c.summary.EquivalentHeaders[header]++
+}
+
+// startComparePrefixes compares two prefixes in a new goroutine if fewer than maxPendingPrefixes are being compared
+// in their own goroutines; otherwise, they are compared in this one before it continues. Either way, the number of
+// goroutines listing prefixes, each of which holds a page or two from each location, is bounded.
+func (s3c *S3Comparer) startComparePrefixes(prefix1, prefix2 string) {
+	if !s3c.pendingPrefixes.TryAcquire(1) {
+		s3c.comparePrefixes(prefix1, prefix2)
 		return
 	}
 
-	if err2 != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read from s3://%s/%s: %v\n", s3c.handler2.bucket, prefix2, err2)
+	s3c.wg.Add(1)
+
+	go func() {
+		defer s3c.wg.Done()
+		defer s3c.pendingPrefixes.Release(1)
+
+		s3c.comparePrefixes(prefix1, prefix2)
+	}()
+}
+
+// comparePrefixes compares the immediate children of two prefixes, merging the two listings as pages arrive. Keys
+// are compared asynchronously, and subprefixes are compared as described by startComparePrefixes.
+func (s3c *S3Comparer) comparePrefixes(prefix1, prefix2 string) {
+	if s3c.ctx.Err() != nil {
 		return
 	}
 
-	// Examine subprefixes found.
-	i := 0
-	j := 0
-	var subprefixesToCompare [][]string
+	atomic.AddUint64(&s3c.summary.Prefixes, 1)
+
+	// The paths of the prefixes relative to the prefixes being compared, which differ if they have been mapped.
+	base1 := prefix1[len(s3c.rootPrefix1):]
+	base2 := prefix2[len(s3c.rootPrefix2):]
+
+	stream1 := newListStream(s3c.handler1, prefix1, s3c.compareVersions, false, s3c.filter, base1)
+	defer stream1.close()
+
+	if s3c.keyMapper != nil {
+		stream1.mapNames(s3c.keyMapper, base2)
+	}
+
+	stream2 := newListStream(s3c.handler2, prefix2, s3c.compareVersions, false, s3c.filter, base2)
+	defer stream2.close()
+
+	for {
+		name1, ok1 := stream1.peek()
+		name2, ok2 := stream2.peek()
+
+		if stream1.err != nil {
+			s3c.printError(s3c.handler1, prefix1, "", operationListObjects, stream1.err)
+			return
+		}
+
+		if stream2.err != nil {
+			s3c.printError(s3c.handler2, prefix2, "", operationListObjects, stream2.err)
+			return
+		}
 
-	for i < len(subprefixes1) && j < len(subprefixes2) {
 		switch {
-		case subprefixes1[i] == subprefixes1[j]:
-			// Subprefix names are equal. Mark them to be compared.
-			subprefix1 := fmt.Sprintf("%s%s", prefix1, subprefixes1[i])
-			subprefix2 := fmt.Sprintf("%s%s", prefix2, subprefixes2[j])
-
-			subprefixesToCompare = append(subprefixesToCompare, []string{subprefix1, subprefix2})
-			i++
-			j++
-		case subprefixes1[i] < subprefixes2[j]:
-			// Missing from bucket2.
-			_ = s3c.printMissing(s3c.handler1.bucket, prefix1, subprefixes1[i], FirstObject)
-			i++
+		case !ok1 && !ok2:
+			return
+
+		case ok1 && ok2 && name1 == name2:
+			// Names are equal. Subprefix names end in "/", which keys in a delimited listing can't, so both are
+			// subprefixes or both are keys.
+			entry1 := stream1.next()
+			entry2 := stream2.next()
+			s3c.printMapError(prefix1, base1, entry1)
+
+			if entry1.isPrefix {
+				s3c.startComparePrefixes(prefix1+entry1.listedName, prefix2+name2)
+			} else {
+				s3c.compareListed(prefix1+entry1.listedName, prefix2+name2, entry1.versions, entry2.versions)
+			}
+
+		case ok1 && (!ok2 || name1 < name2):
+			// Missing from bucket2
+			entry1 := stream1.next()
+			s3c.printMapError(prefix1, base1, entry1)
+
+			mapping := s3c.keyMapping(prefix1+entry1.listedName, prefix2+name1)
+			_ = s3c.printEntryAbsent(s3c.handler1, prefix1, base1, entry1, FirstObject, mapping)
+
 		default:
 			// Missing from bucket1
-			_ = s3c.printMissing(s3c.handler2.bucket, prefix2, subprefixes2[i], SecondObject)
-			j++
+			_ = s3c.printEntryAbsent(s3c.handler2, prefix2, base2, stream2.next(), SecondObject, nil)
 		}
 	}
+}
+
+// asyncCompareFlat compares every key under two prefixes by listing each location without a delimiter and merging
+// the two sorted listings as pages arrive. Absent keys are reported as comparePrefixes would report them: a
+// subprefix with no keys in the other location is reported once, rather than key by key.
+//
+// The listings aren't filtered as they're read, since whether a location has keys in a subprefix depends on all of
+// them; keys are filtered as they're compared or reported instead.
+func (s3c *S3Comparer) asyncCompareFlat(prefix1, prefix2 string) {
+	defer s3c.wg.Done()
 
-	// Only one or none of the following loops will be executed.
+	atomic.AddUint64(&s3c.summary.Prefixes, 1)
 
-	// Print any subdirectories at the end of subprefixes1 missing from subprefxes2.
-	for ; i < len(subprefixes1); i++ {
-		_ = s3c.printMissing(s3c.handler1.bucket, prefix1, subprefixes1[i], FirstObject)
-	}
+	stream1 := newListStream(s3c.handler1, prefix1, s3c.compareVersions, true, nil, "")
+	defer stream1.close()
 
-	// Print any subdirectories at the end of subprefixes2 missing from subprefixes1.
-	for ; j < len(subprefixes2); j++ {
-		_ = s3c.printMissing(s3c.handler2.bucket, prefix2, subprefixes2[j], SecondObject)
+	if s3c.keyMapper != nil {
+		stream1.mapNames(s3c.keyMapper, "")
 	}
 
-	// Look at key names.
-	i = 0
-	j = 0
-	var keysToCompare [][]string
+	stream2 := newListStream(s3c.handler2, prefix2, s3c.compareVersions, true, nil, "")
+	defer stream2.close()
+
+	// The last key read from each location. Every key in a location preceding the other location's next key has
+	// been read, so these are the neighbours of that next key in the location.
+	var last1, last2 string
+
+	for {
+		name1, ok1 := stream1.peek()
+		name2, ok2 := stream2.peek()
+
+		if stream1.err != nil {
+			s3c.printError(s3c.handler1, prefix1, "", operationListObjects, stream1.err)
+			return
+		}
+
+		if stream2.err != nil {
+			s3c.printError(s3c.handler2, prefix2, "", operationListObjects, stream2.err)
+			return
+		}
 
-	for i < len(keys1) && j < len(keys2) {
 		switch {
-		case keys1[i] == keys2[j]:
-			// Key names are equal. Mark them to be compared
-			key1 := fmt.Sprintf("%s%s", prefix1, keys1[i])
-			key2 := fmt.Sprintf("%s%s", prefix2, keys2[j])
+		case !ok1 && !ok2:
+			return
 
-			keysToCompare = append(keysToCompare, []string{key1, key2})
-			i++
-			j++
+		case ok1 && ok2 && name1 == name2:
+			entry1 := stream1.next()
+			entry2 := stream2.next()
+			last1, last2 = name1, name2
 
-		case keys1[i] < keys2[j]:
+			// The listed names differ if the first has been mapped, so only one of them may be selected.
+			included1 := s3c.keyIncluded(entry1.listedName)
+			included2 := s3c.keyIncluded(name2)
+
+			if included1 {
+				s3c.printMapError(prefix1, "", entry1)
+			}
+
+			switch {
+			case included1 && included2:
+				s3c.compareListed(prefix1+entry1.listedName, prefix2+name2, entry1.versions, entry2.versions)
+			case included1:
+				mapping := s3c.keyMapping(prefix1+entry1.listedName, prefix2+name1)
+				_ = s3c.printAbsent(s3c.handler1, prefix1, entry1.listedName, FirstObject, entry1.versions, mapping)
+			case included2:
+				_ = s3c.printAbsent(s3c.handler2, prefix2, name2, SecondObject, entry2.versions, nil)
+			}
+
+		case ok1 && (!ok2 || name1 < name2):
 			// Missing from bucket2
-			_ = s3c.printMissing(s3c.handler1.bucket, prefix1, keys1[i], FirstObject)
-			i++
+			last1 = s3c.printStreamAbsent(stream1, s3c.handler1, prefix1, FirstObject, last2, name2)
 
 		default:
 			// Missing from bucket1
-			_ = s3c.printMissing(s3c.handler2.bucket, prefix2, keys2[j], SecondObject)
-			j++
+			last2 = s3c.printStreamAbsent(stream2, s3c.handler2, prefix2, SecondObject, last1, name1)
 		}
 	}
+}
 
-	// Only one or none of the following loops will be executed.
+// compareListed compares a key found in both locations, given its listed versions (newest first; just the one unless
+// versions are being compared). Objects are compared asynchronously; this waits if too many comparisons are pending.
+func (s3c *S3Comparer) compareListed(key1, key2 string, versions1, versions2 []ListedObject) {
+	atomic.AddUint64(&s3c.summary.Compared, 1)
 
-	// Print any keys at the end of keys1 missing from keys2
-	for ; i < len(keys1); i++ {
-		_ = s3c.printMissing(s3c.handler1.bucket, prefix1, keys1[i], FirstObject)
+	if !versions1[0].IsDeleteMarker {
+		atomic.AddUint64(&s3c.summary.Bytes1, uint64(versions1[0].Size))
 	}
 
-	// Print any keys at the end of keys2 missing from keys1
-	for ; j < len(keys2); j++ {
-		_ = s3c.printMissing(s3c.handler2.bucket, prefix2, keys2[j], SecondObject)
+	if !versions2[0].IsDeleteMarker {
+		atomic.AddUint64(&s3c.summary.Bytes2, uint64(versions2[0].Size))
 	}
 
-	// Spawn off goroutines to compare subprefixes
-	for _, subprefixes := range subprefixesToCompare {
-		s3c.wg.Add(1)
+	if s3c.compareVersions {
+		s3c.compareVersionHistories(key1, key2, versions1, versions2)
 
-		go s3c.asyncComparePrefixes(subprefixes[0], subprefixes[1])
+		// Only compare the latest versions if both exist.
+		if versions1[0].IsDeleteMarker || versions2[0].IsDeleteMarker {
+			return
+		}
 	}
 
-	// Spawn off goroutines to compare keys
-	for _, keys := range keysToCompare {
-		s3c.wg.Add(1)
+	object1 := versions1[0]
+	object2 := versions2[0]
+	object1.Key = key1
+	object2.Key = key2
 
-		go s3c.asyncCompareKeys(keys[0], keys[1])
+	if s3c.listOnly && !s3c.headRequired() && !s3c.listingsDiffer(&object1, &object2) {
+		return
 	}
+
+	if err := s3c.pendingKeys.Acquire(s3c.ctx, 1); err != nil {
+		return
+	}
+
+	s3c.wg.Add(1)
+
+	go s3c.asyncCompareKeys(object1, object2)
 }
 
-func (s3c *S3Comparer) asyncCompareKeys(key1, key2 string) {
+// asyncCompareKeys compares a pair of listed objects (with full keys). If the objects are specific versions, those
+// versions are compared.
+func (s3c *S3Comparer) asyncCompareKeys(object1, object2 ListedObject) {
 	defer s3c.wg.Done()
+	defer s3c.pendingKeys.Release(1)
 
+	key1 := object1.Key
+	key2 := object2.Key
 	rc1 := make(chan *asyncHeadObjectResult, 1)
 	rc2 := make(chan *asyncHeadObjectResult, 1)
 
-	go s3c.handler1.asyncHeadObject(key1, rc1)
-	go s3c.handler2.asyncHeadObject(key2, rc2)
+	go s3c.handler1.asyncHeadObject(key1, object1.VersionID, rc1)
+	go s3c.handler2.asyncHeadObject(key2, object2.VersionID, rc2)
+
+	// Tags and ACLs are fetched concurrently with the object attributes; these channels remain nil if neither is
+	// being compared.
+	var xc1, xc2 chan *asyncExtraHeadersResult
+
+	if s3c.compareTags || s3c.compareACLs {
+		xc1 = make(chan *asyncExtraHeadersResult, 1)
+		xc2 = make(chan *asyncExtraHeadersResult, 1)
+
+		go s3c.handler1.asyncExtraHeaders(key1, object1.VersionID, s3c.compareTags, s3c.compareACLs, s3c.aclIDMap, xc1)
+		go s3c.handler2.asyncExtraHeaders(key2, object2.VersionID, s3c.compareTags, s3c.compareACLs, nil, xc2)
+	}
 
 	var result1 *asyncHeadObjectResult
 	var result2 *asyncHeadObjectResult
+	extra1 := &asyncExtraHeadersResult{}
+	extra2 := &asyncExtraHeadersResult{}
 
-	for rc1 != nil || rc2 != nil {
+	for rc1 != nil || rc2 != nil || xc1 != nil || xc2 != nil {
 		select {
 		case result := <-rc1:
 			result1 = result
@@ -285,44 +752,76 @@ func (s3c *S3Comparer) asyncCompareKeys(key1, key2 string) {
 			result2 = result
 			rc2 = nil
 
+		case result := <-xc1:
+			extra1 = result
+			xc1 = nil
+
+		case result := <-xc2:
+			extra2 = result
+			xc2 = nil
+
 		case <-s3c.ctx.Done():
 			return
 		}
 	}
 
 	if result1.Err != nil {
-		fmt.Fprintf(os.Stderr, "HeadObject on s3://%s/%s failed: %v\n", s3c.handler1.bucket, key1, result1.Err)
+		s3c.printError(s3c.handler1, key1, object1.VersionID, operationHeadObject, result1.Err)
 	}
 
 	if result2.Err != nil {
-		fmt.Fprintf(os.Stderr, "HeadObject on s3://%s/%s failed: %v\n", s3c.handler1.bucket, key2, result2.Err)
+		s3c.printError(s3c.handler2, key2, object2.VersionID, operationHeadObject, result2.Err)
 	}
 
-	if result1.Err != nil || result2.Err != nil {
+	if extra1.Err != nil {
+		s3c.printError(s3c.handler1, key1, object1.VersionID, extra1.Operation, extra1.Err)
+	}
+
+	if extra2.Err != nil {
+		s3c.printError(s3c.handler2, key2, object2.VersionID, extra2.Operation, extra2.Err)
+	}
+
+	if result1.Err != nil || result2.Err != nil || extra1.Err != nil || extra2.Err != nil {
 		return
 	}
 
-	headers1 := headObjectOutputToHeaders(result1.Result)
-	headers2 := headObjectOutputToHeaders(result2.Result)
-	diffsFound := false
+	headers1 := copyHeaders(result1.Result.Headers)
+	headers2 := copyHeaders(result2.Result.Headers)
+	mismatched := []string{}
+
+	for key, value := range extra1.Headers {
+		headers1[key] = value
+	}
+
+	for key, value := range extra2.Headers {
+		headers2[key] = value
+	}
 
-	// See if we have any header diffs.
 	dr := DiffReport{
-		Type: "Mismatch",
-		Objects: []DiffObject{
-			{
-				URL:          fmt.Sprintf("s3://%s/%s", s3c.handler1.bucket, key1),
-				LastModified: result1.Result.LastModified.Format(time.RFC3339Nano),
-			},
-			{
-				URL:          fmt.Sprintf("s3://%s/%s", s3c.handler2.bucket, key2),
-				LastModified: result2.Result.LastModified.Format(time.RFC3339Nano),
-			},
-		},
+		Type:          DiffTypeMismatch,
+		Objects:       s3c.diffObjects(object1, object2, result1.Result, result2.Result),
 		CommonHeaders: make(map[string]string),
 		DiffHeaders:   make(map[string][]string),
+		KeyMapping:    s3c.keyMapping(key1, key2),
 	}
 
+	// Content comparison supersedes the ETag.
+	etagSuperseded := s3c.newContentHash != nil
+
+	addChecksumHeaders(headers1, headers2, result1.Result.Checksums, result2.Result.Checksums)
+
+	if s3c.compareChecksums && commonChecksum(result1.Result.Checksums, result2.Result.Checksums) != "" {
+		etagSuperseded = true
+	}
+
+	if s3c.multipartETags && !etagSuperseded {
+		if reason := s3c.multipartETagEquivalence(object1, object2, headers1, headers2); reason != "" {
+			dr.Equivalences = map[string]string{"etag": reason}
+			s3c.countEquivalentHeader("etag")
+		}
+	}
+
+	// See if we have any header diffs.
 	for key, value1 := range headers1 {
 		value2, found := headers2[key]
 
@@ -331,9 +830,9 @@ func (s3c *S3Comparer) asyncCompareKeys(key1, key2 string) {
 		} else {
 			dr.DiffHeaders[key] = []string{value1, value2}
 
-			// Mark this as a diff only if the header isn't ignored
-			if !s3c.ignoredHeaders[key] {
-				diffsFound = true
+			// Mark this as a diff only if the header isn't ignored or equivalent
+			if !s3c.headerIgnored(key, etagSuperseded) && dr.Equivalences[key] == "" {
+				mismatched = append(mismatched, key)
 			}
 		}
 
@@ -346,25 +845,290 @@ func (s3c *S3Comparer) asyncCompareKeys(key1, key2 string) {
 		// These headers are known to be missing from headers1
 		dr.DiffHeaders[key] = []string{"", value2}
 
-		if !s3c.ignoredHeaders[key] {
-			diffsFound = true
+		if !s3c.headerIgnored(key, etagSuperseded) {
+			mismatched = append(mismatched, key)
 		}
 	}
 
-	if !diffsFound {
-		// All non-ignored headers equal; stop here.
+	if len(mismatched) > 0 {
+		s3c.countMismatchedHeaders(mismatched)
+		_ = s3c.printDiff(&dr)
+	}
+
+	if s3c.newContentHash != nil {
+		s3c.compareContent(object1, object2, result1.Result, result2.Result)
+	}
+}
+
+// compareVersionHistories compares the version histories (listed newest first) of two keys. Versions are reported as
+// version-NNNN pseudo-headers, numbered from the oldest version.
+func (s3c *S3Comparer) compareVersionHistories(key1, key2 string, history1, history2 []ListedObject) {
+	dr := DiffReport{
+		Type: DiffTypeVersionMismatch,
+		Objects: []DiffObject{
+			{
+				URL:          s3c.handler1.url(key1),
+				VersionID:    history1[0].VersionID,
+				LastModified: history1[0].LastModified.Format(time.RFC3339Nano),
+			},
+			{
+				URL:          s3c.handler2.url(key2),
+				VersionID:    history2[0].VersionID,
+				LastModified: history2[0].LastModified.Format(time.RFC3339Nano),
+			},
+		},
+		CommonHeaders: make(map[string]string),
+		DiffHeaders:   make(map[string][]string),
+		KeyMapping:    s3c.keyMapping(key1, key2),
+	}
+	mismatched := []string{}
+
+	for n := 0; n < len(history1) || n < len(history2); n++ {
+		var value1, value2 string
+
+		if n < len(history1) {
+			value1 = describeVersion(history1[len(history1)-1-n])
+		}
+
+		if n < len(history2) {
+			value2 = describeVersion(history2[len(history2)-1-n])
+		}
+
+		header := fmt.Sprintf("version-%04d", n+1)
+
+		if value1 == value2 {
+			dr.CommonHeaders[header] = value1
+		} else {
+			dr.DiffHeaders[header] = []string{value1, value2}
+
+			if !s3c.ignoredHeaders[header] {
+				mismatched = append(mismatched, header)
+			}
+		}
+	}
+
+	if len(mismatched) > 0 {
+		s3c.countMismatchedHeaders(mismatched)
+		_ = s3c.printDiff(&dr)
+	}
+}
+
+// multipartETagEquivalence determines whether two objects with differing ETags have the same contents by recomputing
+// the multipart ETag of one using the part layout of the other. It returns the reason they are equivalent, or "" if
+// they are not (or if equivalence cannot be determined).
+func (s3c *S3Comparer) multipartETagEquivalence(object1, object2 ListedObject, headers1, headers2 map[string]string,
+) string {
+	etag1 := headers1["etag"]
+	etag2 := headers2["etag"]
+
+	if etag1 == etag2 || headers1["content-length"] != headers2["content-length"] {
+		return ""
+	}
+
+	// Use the part layout of the multipart object (preferring the second if both are) and read the other object.
+	var multipart, other *asyncS3Handler
+	var multipartObject, otherObject ListedObject
+	var multipartETag string
+
+	switch {
+	case multipartCount(etag2) > 0:
+		multipart, multipartObject, multipartETag = s3c.handler2, object2, etag2
+		other, otherObject = s3c.handler1, object1
+	case multipartCount(etag1) > 0:
+		multipart, multipartObject, multipartETag = s3c.handler1, object1, etag1
+		other, otherObject = s3c.handler2, object2
+	default:
+		return ""
+	}
+
+	partSize, partCount, err := multipart.partLayout(multipartObject.Key, multipartObject.VersionID)
+	if err != nil {
+		s3c.printError(multipart, multipartObject.Key, multipartObject.VersionID, operationHeadObject, err)
+		return ""
+	}
+
+	if partCount == 0 || partSize <= 0 {
+		return ""
+	}
+
+	computedETag, err := other.multipartETag(otherObject.Key, otherObject.VersionID, partSize)
+	if err != nil {
+		s3c.printError(other, otherObject.Key, otherObject.VersionID, operationGetObject, err)
+		return ""
+	}
+
+	if computedETag != multipartETag {
+		return ""
+	}
+
+	return fmt.Sprintf("multipart ETag recomputed from %s using %d parts of %d bytes",
+		other.url(otherObject.Key), partCount, partSize)
+}
+
+// compareContent downloads and hashes both objects, reporting a ContentMismatch if they differ. Objects whose lengths
+// differ are not downloaded, since the header comparison has reported them.
+func (s3c *S3Comparer) compareContent(object1, object2 ListedObject, info1, info2 *ObjectInfo) {
+	dr := DiffReport{
+		Type:        DiffTypeContentMismatch,
+		Objects:     s3c.diffObjects(object1, object2, info1, info2),
+		DiffHeaders: make(map[string][]string),
+		KeyMapping:  s3c.keyMapping(object1.Key, object2.Key),
+	}
+
+	// Objects of different lengths can't have the same contents; this has been reported as a Mismatch already.
+	if info1.Headers["content-length"] != info2.Headers["content-length"] {
 		return
 	}
 
+	rc1 := make(chan *asyncHashObjectResult, 1)
+	rc2 := make(chan *asyncHashObjectResult, 1)
+
+	go s3c.handler1.asyncHashObject(object1.Key, object1.VersionID, s3c.newContentHash, rc1)
+	go s3c.handler2.asyncHashObject(object2.Key, object2.VersionID, s3c.newContentHash, rc2)
+
+	var result1 *asyncHashObjectResult
+	var result2 *asyncHashObjectResult
+
+	for rc1 != nil || rc2 != nil {
+		select {
+		case result := <-rc1:
+			result1 = result
+			rc1 = nil
+
+		case result := <-rc2:
+			result2 = result
+			rc2 = nil
+
+		case <-s3c.ctx.Done():
+			return
+		}
+	}
+
+	if result1.Err != nil {
+		s3c.printError(s3c.handler1, object1.Key, object1.VersionID, operationGetObject, result1.Err)
+	}
+
+	if result2.Err != nil {
+		s3c.printError(s3c.handler2, object2.Key, object2.VersionID, operationGetObject, result2.Err)
+	}
+
+	if result1.Err != nil || result2.Err != nil {
+		return
+	}
+
+	if bytes.Equal(result1.Digest, result2.Digest) {
+		return
+	}
+
+	dr.DiffHeaders["content-"+s3c.contentHashName] = []string{
+		hex.EncodeToString(result1.Digest), hex.EncodeToString(result2.Digest),
+	}
+	s3c.countMismatchedHeaders([]string{"content-" + s3c.contentHashName})
 	_ = s3c.printDiff(&dr)
 }
 
+// headRequired indicates whether objects must be examined beyond their listings even if the listings are the same.
+func (s3c *S3Comparer) headRequired() bool {
+	return len(s3c.compareHeaders) > 0 || s3c.compareChecksums || s3c.compareTags || s3c.compareACLs ||
+		s3c.newContentHash != nil
+}
+
+// listingsDiffer indicates whether the listings of two objects differ in a header that isn't ignored. An ETag missing
+// from either listing (as with local files) can't be compared, so it counts as a difference.
+func (s3c *S3Comparer) listingsDiffer(object1, object2 *ListedObject) bool {
+	headers1 := listedObjectHeaders(object1)
+	headers2 := listedObjectHeaders(object2)
+
+	if (headers1["etag"] == "" || headers2["etag"] == "") && !s3c.headerIgnored("etag", false) {
+		return true
+	}
+
+	for key := range headers2 {
+		if _, found := headers1[key]; !found {
+			headers1[key] = ""
+		}
+	}
+
+	for key, value1 := range headers1 {
+		if value1 != headers2[key] && !s3c.headerIgnored(key, false) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// headerIgnored indicates whether differences in the given header should not be reported. If etagSuperseded is set,
+// the contents are being compared by other means and the ETag is ignored.
+func (s3c *S3Comparer) headerIgnored(header string, etagSuperseded bool) bool {
+	if s3c.ignoredHeaders[header] {
+		return true
+	}
+
+	return header == "etag" && etagSuperseded
+}
+
+// keyMapping returns the mapping of key1 in the first location to key2 in the second, or nil if key1 wasn't mapped to a
+// different path.
+func (s3c *S3Comparer) keyMapping(key1, key2 string) *KeyMapping {
+	path1 := key1[len(s3c.rootPrefix1):]
+	path2 := key2[len(s3c.rootPrefix2):]
+
+	if s3c.keyMapper == nil || path1 == path2 {
+		return nil
+	}
+
+	return &KeyMapping{Key1: path1, Key2: path2}
+}
+
+// diffObjects returns the DiffObjects describing a pair of objects being compared.
+func (s3c *S3Comparer) diffObjects(object1, object2 ListedObject, info1, info2 *ObjectInfo) []DiffObject {
+	return []DiffObject{
+		{
+			URL:          s3c.handler1.url(object1.Key),
+			VersionID:    object1.VersionID,
+			LastModified: info1.LastModified.Format(time.RFC3339Nano),
+		},
+		{
+			URL:          s3c.handler2.url(object2.Key),
+			VersionID:    object2.VersionID,
+			LastModified: info2.LastModified.Format(time.RFC3339Nano),
+		},
+	}
+}
+
 func (s3c *S3Comparer) printDiff(dr *DiffReport) error {
-	if s3c.outputFormat == OutputFormatText {
+	position := FirstObject
+	if dr.Objects[FirstObject].URL == "" {
+		position = SecondObject
+	}
+
+	s3c.summary.countDiff(dr.Type, position)
+
+	return s3c.writeReport(dr)
+}
+
+// writeReport writes a report (which has been counted) to the output in the output format.
+func (s3c *S3Comparer) writeReport(dr *DiffReport) error {
+	switch {
+	case s3c.outputFormat == OutputFormatText && dr.Type == DiffTypeError:
+		return s3c.printErrorText(dr)
+	case s3c.outputFormat == OutputFormatText:
 		return s3c.printDiffText(dr)
+	case s3c.outputFormat == OutputFormatJSON || s3c.outputFormat == OutputFormatNDJSON:
+		return s3c.printDiffJSON(dr)
+	default:
+		s3c.holdReport(dr)
+		return nil
 	}
+}
 
-	return s3c.printDiffJSON(dr)
+// holdReport holds a report until the end of the comparison, for output formats that are written all at once.
+func (s3c *S3Comparer) holdReport(dr *DiffReport) {
+	s3c.outputMutex.Lock()
+	defer s3c.outputMutex.Unlock()
+
+	s3c.heldReports = append(s3c.heldReports, dr)
 }
 
 func (s3c *S3Comparer) write(data []byte) error {
@@ -384,9 +1148,11 @@ func (s3c *S3Comparer) write(data []byte) error {
 func (s3c *S3Comparer) printDiffText(dr *DiffReport) error {
 	all := &strings.Builder{}
 	body := &strings.Builder{}
-	nameLen := maxint(len(dr.Objects[0].URL), len(dr.Objects[1].URL))
-	fmt.Fprintf(all, "--- %-.*s %s\n", nameLen, dr.Objects[0].URL, dr.Objects[0].LastModified)
-	fmt.Fprintf(all, "+++ %-.*s %s\n", nameLen, dr.Objects[1].URL, dr.Objects[1].LastModified)
+	name1 := dr.Objects[0].displayName()
+	name2 := dr.Objects[1].displayName()
+	nameLen := maxint(len(name1), len(name2))
+	fmt.Fprintf(all, "--- %-.*s %s\n", nameLen, name1, dr.Objects[0].LastModified)
+	fmt.Fprintf(all, "+++ %-.*s %s\n", nameLen, name2, dr.Objects[1].LastModified)
 
 	keysSorted := make([]string, 0, len(dr.CommonHeaders)+len(dr.DiffHeaders))
 	for key := range dr.CommonHeaders {
@@ -419,6 +1185,10 @@ func (s3c *S3Comparer) printDiffText(dr *DiffReport) error {
 				fmt.Fprintf(body, "+%s: %s\n", key, values[1])
 				path2Lines++
 			}
+			if reason, found := dr.Equivalences[key]; found {
+				// Annotation lines (like "\ No newline at end of file") aren't counted in the line information.
+				fmt.Fprintf(body, "\\ %s equivalent: %s\n", key, reason)
+			}
 		}
 	}
 
@@ -434,6 +1204,56 @@ func (s3c *S3Comparer) printDiffText(dr *DiffReport) error {
 	return s3c.write([]byte(all.String()))
 }
 
+// printErrorText writes an Error report as a single line.
+func (s3c *S3Comparer) printErrorText(dr *DiffReport) error {
+	object := dr.Objects[FirstObject]
+	if object.URL == "" {
+		object = dr.Objects[SecondObject]
+	}
+
+	message := dr.Error.Message
+	if dr.Error.Code != "" {
+		message = dr.Error.Code + ": " + message
+	}
+
+	data := fmt.Sprintf("Error: %s on %s failed: %s\n", dr.Error.Operation, object.displayName(), message)
+
+	s3c.outputMutex.Lock()
+	defer s3c.outputMutex.Unlock()
+
+	return s3c.write([]byte(data))
+}
+
+// writeSummary writes the summary at the end of the output.
+func (s3c *S3Comparer) writeSummary(summary *Summary) error {
+	if s3c.outputFormat == OutputFormatText {
+		s3c.outputMutex.Lock()
+		defer s3c.outputMutex.Unlock()
+
+		return s3c.write([]byte(summary.text(s3c.handler1.url(s3c.rootPrefix1), s3c.handler2.url(s3c.rootPrefix2))))
+	}
+
+	data, err := json.Marshal(&summaryReport{Type: DiffTypeSummary, Summary: summary})
+	if err != nil {
+		return err
+	}
+
+	return s3c.writeJSON(data)
+}
+
+// writeJSON writes an element of JSON output: preceded by a separator within the JSON array, or on a line of its own
+// for NDJSON output.
+func (s3c *S3Comparer) writeJSON(data []byte) error {
+	s3c.outputMutex.Lock()
+	defer s3c.outputMutex.Unlock()
+
+	if s3c.outputFormat == OutputFormatNDJSON {
+		return s3c.write(append(data, '\n'))
+	}
+
+	return s3c.write(append(s3c.jsonSeparator(), data...))
+}
+
 // jsonSeparator returns the next JSON separator to use for writing output.
 // This must be called with outputMutex held.
 func (s3c *S3Comparer) jsonSeparator() []byte {
@@ -451,35 +1271,235 @@ func (s3c *S3Comparer) printDiffJSON(dr *DiffReport) error {
 		return err
 	}
 
-	s3c.outputMutex.Lock()
-	defer s3c.outputMutex.Unlock()
-	var data = s3c.jsonSeparator()
-	data = append(data, drBytes...)
+	return s3c.writeJSON(drBytes)
+}
+
+// printError reports an error from an operation on a key (or, for listings, a prefix) in the location of the given
+// handler, which prevented it from being compared. Errors caused by the comparison being cancelled are not reported.
+func (s3c *S3Comparer) printError(handler *asyncS3Handler, key, versionID, operation string, err error) {
+	if s3c.ctx.Err() != nil && errors.Is(err, s3c.ctx.Err()) {
+		return
+	}
 
-	return s3c.write(data)
+	position := FirstObject
+	if handler == s3c.handler2 {
+		position = SecondObject
+	}
+
+	dr := OnlyInDiffReport(DiffTypeError, handler.url(key), position)
+	dr.Objects[position].VersionID = versionID
+	dr.Error = &DiffError{Operation: operation, Code: errorCode(err), Message: errorMessage(err)}
+
+	_ = s3c.printDiff(dr)
 }
 
-func (s3c *S3Comparer) printMissing(bucket, prefix, key string, position DiffObjectPosition) error {
-	if s3c.outputFormat == OutputFormatText {
-		data := fmt.Sprintf("Only in s3://%s/%s: %s\n", bucket, prefix, key)
+func (s3c *S3Comparer) printMissing(handler *asyncS3Handler, prefix, key string, position DiffObjectPosition,
+	mapping *KeyMapping) error {
+	return s3c.printOnlyIn(DiffTypeMissing, handler, prefix, key, "", position, mapping)
+}
 
-		s3c.outputMutex.Lock()
-		defer s3c.outputMutex.Unlock()
+// printAbsent reports a key found in only one location, distinguishing keys that only have delete markers from keys
+// that exist. The version listed first (the latest) is reported.
+func (s3c *S3Comparer) printAbsent(handler *asyncS3Handler, prefix, key string, position DiffObjectPosition,
+	versions []ListedObject, mapping *KeyMapping) error {
+	if onlyDeleteMarkers(versions) {
+		return s3c.printOnlyIn(DiffTypeDeleteMarker, handler, prefix, key, versions[0].VersionID, position, mapping)
+	}
 
-		return s3c.write([]byte(data))
+	return s3c.printOnlyIn(DiffTypeMissing, handler, prefix, key, versions[0].VersionID, position, mapping)
+}
+
+// printEntryAbsent reports a subprefix or key found in only one location. The path of prefix relative to the prefix
+// being compared is base. If keys are being filtered, a subprefix is only reported if it has keys to compare.
+func (s3c *S3Comparer) printEntryAbsent(handler *asyncS3Handler, prefix, base string, entry *listEntry,
+	position DiffObjectPosition, mapping *KeyMapping) error {
+	if entry.isPrefix {
+		if s3c.filter != nil && !s3c.prefixIncluded(handler, prefix+entry.listedName, base+entry.listedName) {
+			return nil
+		}
+
+		return s3c.printMissing(handler, prefix, entry.listedName, position, mapping)
 	}
 
-	dr := MissingDiffReport(fmt.Sprintf("s3://%s/%s%s", bucket, prefix, key), position)
-	drBytes, err := json.Marshal(dr)
+	return s3c.printAbsent(handler, prefix, entry.listedName, position, entry.versions, mapping)
+}
 
-	if err != nil {
-		return err
+// printMapError reports that an entry of the first location couldn't be mapped to a name in the second location, if
+// it couldn't. The path of prefix relative to the prefix being compared is base. The error is only reported if the
+// filter selects the key, or any key under the subprefix, so the same errors are reported whether or not the listing
+// is flat; the caller checks keys in flat listings, which aren't filtered as they're read.
+func (s3c *S3Comparer) printMapError(prefix, base string, entry *listEntry) {
+	if entry.mapErr == nil {
+		return
 	}
 
-	s3c.outputMutex.Lock()
-	defer s3c.outputMutex.Unlock()
-	data := s3c.jsonSeparator()
-	data = append(data, drBytes...)
+	if entry.isPrefix && s3c.filter != nil && !s3c.prefixIncluded(s3c.handler1, prefix+entry.listedName,
+		base+entry.listedName) {
+		return
+	}
+
+	s3c.printError(s3c.handler1, prefix+entry.listedName, "", operationMapKey, entry.mapErr)
+}
+
+// keyIncluded indicates whether the filter, if any, selects the key with the given path relative to the prefixes being
+// compared.
+func (s3c *S3Comparer) keyIncluded(path string) bool {
+	return s3c.filter == nil || s3c.filter.includeKey(path)
+}
+
+// prefixIncluded indicates whether the filter selects any key under prefix (at any depth), whose relative path is
+// base. Each level is listed separately so that directories the filter excludes, or that no include pattern can match
+// under, aren't listed; the search stops at the first key selected. If a listing fails, the prefix is assumed to be
+// included.
+func (s3c *S3Comparer) prefixIncluded(handler *asyncS3Handler, prefix, base string) bool {
+	var subprefixes []string
+
+	stream := newListStream(handler, prefix, s3c.compareVersions, false, s3c.filter, base)
+
+	for {
+		if _, ok := stream.peek(); !ok {
+			break
+		}
+
+		entry := stream.next()
+		if !entry.isPrefix {
+			stream.close()
+			return true
+		}
+
+		subprefixes = append(subprefixes, entry.listedName)
+	}
+
+	stream.close()
+
+	if stream.err != nil {
+		s3c.printError(handler, prefix, "", operationListObjects, stream.err)
+		return true
+	}
+
+	for _, subprefix := range subprefixes {
+		if s3c.prefixIncluded(handler, prefix+subprefix, base+subprefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// printStreamAbsent reports the next key of a recursive listing as absent from the other location, whose keys
+// immediately before and after it are given. If the other location has no keys in the subprefix containing it, the
+// subprefix is reported instead (if the filter selects any of its keys) and its keys are skipped. It returns the last
+// key read. The keys given and read are unfiltered, so the subprefixes reported are those comparePrefixes would.
+//
+// If the listing's keys have been mapped, the key (or subprefix) is reported in the directory it was listed in, which
+// comparePrefixes would have mapped to the directory containing the mapped key. Keys mapped into the subprefix from
+// different directories are reported in each of them, and keys mapped to another directory are reported on their
+// own, as they were listed.
+func (s3c *S3Comparer) printStreamAbsent(stream *listStream, handler *asyncS3Handler, prefix string,
+	position DiffObjectPosition, before, after string) string {
+	entry := stream.next()
+
+	// Find the deepest subprefix the other location has keys in.
+	depth := maxint(commonDirLen(entry.name, before), commonDirLen(entry.name, after))
+	parent := entry.name[:depth]
+
+	slash := strings.Index(entry.name[depth:], "/")
+	if slash < 0 {
+		s3c.printStreamKeyAbsent(stream, handler, prefix, position, entry, parent)
+		return entry.name
+	}
+
+	subprefix := entry.name[:depth+slash+1]
+
+	// The subprefixes, as listed, that have been reported.
+	reported := make(map[string]bool)
+
+	for last := entry; ; {
+		listedParent, listedSubprefix, found := stream.listedDirs(last, parent, subprefix)
+
+		switch {
+		case !found:
+			s3c.printStreamKeyAbsent(stream, handler, prefix, position, last, parent)
+
+		case !reported[listedSubprefix] && s3c.keyIncluded(last.listedName):
+			// Only keys in the first location are mapped.
+			var mapping *KeyMapping
+			if stream.mapper != nil {
+				mapping = s3c.keyMapping(prefix+listedSubprefix, s3c.rootPrefix2+subprefix)
+			}
+
+			_ = s3c.printMissing(handler, prefix+listedParent, listedSubprefix[len(listedParent):], position, mapping)
+			reported[listedSubprefix] = true
+		}
+
+		name, ok := stream.peek()
+		if !ok || !strings.HasPrefix(name, subprefix) {
+			return last.name
+		}
+
+		last = stream.next()
+	}
+}
+
+// printStreamKeyAbsent reports a key of a recursive listing as absent from the other location, if the filter selects
+// it. The key is reported in its directory in the other location, parent, or if its keys have been mapped, the
+// directory it was listed in that was mapped to parent. If there is none, it is reported on its own, as it was listed.
+func (s3c *S3Comparer) printStreamKeyAbsent(stream *listStream, handler *asyncS3Handler, prefix string,
+	position DiffObjectPosition, entry *listEntry, parent string) {
+	if !s3c.keyIncluded(entry.listedName) {
+		return
+	}
+
+	listedParent := parent
+
+	var mapping *KeyMapping
+
+	if stream.mapper != nil {
+		mapping = s3c.keyMapping(prefix+entry.listedName, s3c.rootPrefix2+entry.name)
+
+		var found bool
+		if entry.mapErr == nil {
+			listedParent, found = stream.unmappedDir(entry.listedName, parent)
+		}
+
+		if !found {
+			s3c.printMapError(prefix, "", entry)
+			listedParent = ""
+		}
+	}
+
+	_ = s3c.printAbsent(handler, prefix+listedParent, entry.listedName[len(listedParent):], position, entry.versions,
+		mapping)
+}
+
+// printOnlyIn reports a key (or subprefix) found in only one location. If mapping is not nil, it is the mapping of the
+// key to the one expected in the second location.
+func (s3c *S3Comparer) printOnlyIn(diffType DiffType, handler *asyncS3Handler, prefix, key, versionID string,
+	position DiffObjectPosition, mapping *KeyMapping) error {
+	s3c.summary.countDiff(diffType, position)
+
+	if s3c.outputFormat == OutputFormatText {
+		var data string
+
+		if diffType == DiffTypeDeleteMarker {
+			data = fmt.Sprintf("Only delete markers in %s: %s", handler.url(prefix), key)
+		} else {
+			data = fmt.Sprintf("Only in %s: %s", handler.url(prefix), key)
+		}
+
+		if mapping != nil {
+			data += fmt.Sprintf(" (mapped to %s)", s3c.handler2.url(s3c.rootPrefix2+mapping.Key2))
+		}
+
+		s3c.outputMutex.Lock()
+		defer s3c.outputMutex.Unlock()
+
+		return s3c.write([]byte(data + "\n"))
+	}
+
+	dr := OnlyInDiffReport(diffType, handler.url(prefix+key), position)
+	dr.Objects[position].VersionID = versionID
+	dr.KeyMapping = mapping
 
-	return s3c.write(data)
+	return s3c.writeReport(dr)
 }
@@ -0,0 +1,772 @@
+package s3compare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTree creates a directory containing the given files (keyed by slash-separated path), all with the same
+// modification time and permissions, and returns its path.
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	root := t.TempDir()
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for name, contents := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+// compareTrees compares two local directories, with options set by setup (if not nil), returning the text output and
+// the summary.
+func compareTrees(t *testing.T, root1, root2 string, setup func(s3c *S3Comparer)) (string, Summary) {
+	t.Helper()
+
+	output := &bytes.Buffer{}
+	s3c := NewS3Comparer(context.Background(), output, OutputFormatText, NewLocalBackend(root1), NewLocalBackend(root2))
+
+	if setup != nil {
+		setup(s3c)
+	}
+
+	summary := s3c.ComparePrefixes("", "")
+
+	return output.String(), summary
+}
+
+func TestCompareContentLengthDiffers(t *testing.T) {
+	root1 := writeTree(t, map[string]string{"a": "1"})
+	root2 := writeTree(t, map[string]string{"a": "22"})
+
+	output, summary := compareTrees(t, root1, root2, func(s3c *S3Comparer) {
+		if err := s3c.CompareContent(DefaultContentHash); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if summary.Mismatched != 1 || summary.MismatchedHeaders["content-length"] != 1 {
+		t.Errorf("expected one mismatch of content-length; got %+v:\n%s", summary, output)
+	}
+}
+
+func TestComparePrefixesManySubprefixes(t *testing.T) {
+	// More subprefixes than can be compared in their own goroutines, so some are compared in their parent's.
+	files1 := make(map[string]string)
+	files2 := make(map[string]string)
+
+	for i := 0; i < 3*int(maxPendingPrefixes); i++ {
+		files1[fmt.Sprintf("d%03d/e/a", i)] = "1"
+		files2[fmt.Sprintf("d%03d/e/a", i)] = "2"
+	}
+
+	output, summary := compareTrees(t, writeTree(t, files1), writeTree(t, files2), nil)
+
+	if expected := 3 * uint64(maxPendingPrefixes); summary.Prefixes != 2*expected+1 || summary.Compared != expected ||
+		summary.Mismatched != expected {
+		t.Errorf("expected %d prefixes, %d keys compared and mismatched; got %+v:\n%s", 2*expected+1, expected, summary,
+			output)
+	}
+}
+
+func TestCompareFlatFiltered(t *testing.T) {
+	tests := []struct {
+		name     string
+		files1   map[string]string
+		files2   map[string]string
+		include  []string
+		exclude  []string
+		expected []string
+	}{
+		{
+			name:     "other location's keys in the directory are excluded",
+			files1:   map[string]string{"d/a.txt": "1", "d/x.crc": "1"},
+			files2:   map[string]string{"d/x.crc": "1"},
+			exclude:  []string{"*.crc"},
+			expected: []string{"Only in 1/d/: a.txt"},
+		},
+		{
+			name:     "directories only in one location",
+			files1:   map[string]string{"d/a.txt": "1", "d/b.txt": "1", "e/x.crc": "1"},
+			files2:   map[string]string{"f/a.txt": "1"},
+			exclude:  []string{"*.crc"},
+			expected: []string{"Only in 1/: d/", "Only in 2/: f/"},
+		},
+		{
+			name:     "nested directories",
+			files1:   map[string]string{"d/e/a": "1", "d/e/b.crc": "1", "d/f.crc": "1", "g/a": "1"},
+			files2:   map[string]string{"d/e/b.crc": "1", "d/f.crc": "1"},
+			exclude:  []string{"*.crc"},
+			expected: []string{"Only in 1/: g/", "Only in 1/d/e/: a"},
+		},
+		{
+			name:     "include pattern",
+			files1:   map[string]string{"d/a.txt": "1", "d/b.bin": "1", "e/c.txt": "1"},
+			files2:   map[string]string{"d/b.bin": "1"},
+			include:  []string{"d/*.txt"},
+			expected: []string{"Only in 1/d/: a.txt"},
+		},
+	}
+
+	for _, test := range tests {
+		root1 := writeTree(t, test.files1)
+		root2 := writeTree(t, test.files2)
+
+		var outputs [2][]string
+
+		for i, flat := range []bool{false, true} {
+			output, _ := compareTrees(t, root1, root2, func(s3c *S3Comparer) {
+				for _, pattern := range test.include {
+					if err := s3c.Include(pattern); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				for _, pattern := range test.exclude {
+					if err := s3c.Exclude(pattern); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if flat {
+					s3c.FlatListing()
+				}
+			})
+
+			output = strings.ReplaceAll(output, fileURLPrefix+filepath.ToSlash(root1), "1")
+			output = strings.ReplaceAll(output, fileURLPrefix+filepath.ToSlash(root2), "2")
+			outputs[i] = strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+			sort.Strings(outputs[i])
+		}
+
+		if !reflect.DeepEqual(outputs[0], test.expected) || !reflect.DeepEqual(outputs[1], test.expected) {
+			t.Errorf("%s: expected %#v; got %#v delimited, %#v flat", test.name, test.expected, outputs[0], outputs[1])
+		}
+	}
+}
+
+func TestMapKeyError(t *testing.T) {
+	root1 := writeTree(t, map[string]string{"d/a": "1"})
+	root2 := writeTree(t, map[string]string{"e/x/a": "1"})
+
+	// Subprefixes can't be mapped to a different directory in a delimited listing.
+	output, summary := compareTrees(t, root1, root2, func(s3c *S3Comparer) {
+		if err := s3c.MapKey("s|^d/|e/x/|"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if summary.Errored != 1 || !strings.Contains(output, "Error: MapKey on ") {
+		t.Errorf("expected one MapKey error; got %+v:\n%s", summary, output)
+	}
+}
+
+func TestMapKeyMergedDirectory(t *testing.T) {
+	root1 := writeTree(t, map[string]string{"a/x": "1", "b/y": "1"})
+	root2 := writeTree(t, map[string]string{"a/x": "1"})
+	replacer := strings.NewReplacer(
+		fileURLPrefix+filepath.ToSlash(root1)+"/", "{1}", fileURLPrefix+filepath.ToSlash(root2)+"/", "{2}")
+
+	// Merging b/ into a/ moves b/y into a directory that is listed, which only a flat listing can map.
+	expected := map[bool]string{
+		false: "Error: MapKey on {1}b/ failed: cannot map to \"a/\": another entry is mapped to or listed as it\n" +
+			"Only in {1}: b/\n",
+		true: "Only in {1}b/: y (mapped to {2}a/y)\n",
+	}
+
+	for _, flat := range []bool{false, true} {
+		output, _ := compareTrees(t, root1, root2, func(s3c *S3Comparer) {
+			if err := s3c.MapKey(`s/^b\//a\//`); err != nil {
+				t.Fatal(err)
+			}
+
+			if flat {
+				s3c.FlatListing()
+			}
+		})
+
+		if output = replacer.Replace(output); output != expected[flat] {
+			t.Errorf("flat=%v: expected %#v; got %#v", flat, expected[flat], output)
+		}
+	}
+}
+
+func TestMapKeyInterleavedDirectories(t *testing.T) {
+	root1 := writeTree(t, map[string]string{"a/x": "1", "a/z": "1", "ab/y": "1"})
+	root2 := writeTree(t, map[string]string{"c": "1"})
+	replacer := strings.NewReplacer(
+		fileURLPrefix+filepath.ToSlash(root1)+"/", "{1}", fileURLPrefix+filepath.ToSlash(root2)+"/", "{2}")
+
+	// a/ is mapped to ab/, so its keys are listed between those of ab/; each directory is reported once.
+	output, _ := compareTrees(t, root1, root2, func(s3c *S3Comparer) {
+		if err := s3c.MapKey(`s/^a\//ab\//`); err != nil {
+			t.Fatal(err)
+		}
+
+		s3c.FlatListing()
+	})
+
+	lines := strings.Split(strings.TrimSuffix(replacer.Replace(output), "\n"), "\n")
+	sort.Strings(lines)
+	expected := []string{"Only in {1}: a/ (mapped to {2}ab/)", "Only in {1}: ab/", "Only in {2}: c"}
+
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected %#v; got %#v", expected, lines)
+	}
+}
+
+func TestCompareEmptyDirectories(t *testing.T) {
+	// Directories without files have no keys, so they aren't reported, with or without -flat.
+	root1 := writeTree(t, map[string]string{"a": "1", "d/e/b": "1"})
+	root2 := writeTree(t, map[string]string{"a": "1"})
+
+	for _, dir := range []string{"empty", "nested/empty"} {
+		if err := os.MkdirAll(filepath.Join(root1, filepath.FromSlash(dir)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := "Only in " + fileURLPrefix + filepath.ToSlash(root1) + "/: d/\n"
+
+	for _, flat := range []bool{false, true} {
+		output, summary := compareTrees(t, root1, root2, func(s3c *S3Comparer) {
+			if flat {
+				s3c.FlatListing()
+			}
+		})
+
+		if output != expected || summary.OnlyIn1 != 1 || summary.OnlyIn2 != 0 {
+			t.Errorf("flat=%v: expected %#v; got %#v (%+v)", flat, expected, output, summary)
+		}
+	}
+}
+
+func TestIgnoreHeaderAlias(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := newMemoryBackend("bucket2")
+
+	backend1.put("index.html", "x", modified).headers["x-amz-website-redirect-location"] = "/a.html"
+	backend2.put("index.html", "x", modified).headers["x-amz-website-redirect-location"] = "/b.html"
+
+	// The header was documented as Website-Redirect-Location before it was compared.
+	s3c := NewS3Comparer(context.Background(), &bytes.Buffer{}, OutputFormatText, backend1, backend2)
+	s3c.IgnoreHeader("Website-Redirect-Location")
+
+	if summary := s3c.ComparePrefixes("", ""); !summary.Identical() {
+		t.Errorf("expected the redirect location to be ignored; got %+v", summary)
+	}
+}
+
+func TestMapKeyFlatAndDelimited(t *testing.T) {
+	root1 := writeTree(t, map[string]string{
+		"year=2025/a.json": "1",
+		"year=2026/a.json": "1",
+		"year=2026/b.json": "1",
+		"year=2026/c.txt":  "1",
+		"other/d.json":     "1",
+	})
+	root2 := writeTree(t, map[string]string{
+		"2026/a.json.gz":  "1",
+		"2026/b.json.gz":  "2",
+		"2026/c.txt":      "1",
+		"2027/a.json.gz":  "1",
+		"other/d.json.gz": "1",
+	})
+
+	var outputs [2]string
+
+	for i, flat := range []bool{false, true} {
+		output, summary := compareTrees(t, root1, root2, func(s3c *S3Comparer) {
+			for _, rule := range []string{`s/\.json$/.json.gz/`, `s|^year=([0-9]+)/|$1/|`} {
+				if err := s3c.MapKey(rule); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if flat {
+				s3c.FlatListing()
+			}
+		})
+
+		if summary.Errored != 0 {
+			t.Errorf("flat=%v: expected no errors; got %+v:\n%s", flat, summary, output)
+		}
+
+		// Subprefixes are reported as they're found, so only the order of reports may differ.
+		lines := strings.Split(output, "\n")
+		sort.Strings(lines)
+		outputs[i] = strings.Join(lines, "\n")
+	}
+
+	if outputs[0] != outputs[1] {
+		t.Errorf("expected the same reports with and without -flat; got:\n%s\nand:\n%s", outputs[0], outputs[1])
+	}
+
+	for _, expected := range []string{
+		"Only in {1}: year=2025/ (mapped to {2}2025/)", "Only in {2}: 2027/", "+++ {2}2026/b.json.gz",
+	} {
+		expected = strings.NewReplacer(
+			"{1}", fileURLPrefix+filepath.ToSlash(root1)+"/", "{2}", fileURLPrefix+filepath.ToSlash(root2)+"/",
+		).Replace(expected)
+
+		if !strings.Contains(outputs[0], expected) {
+			t.Errorf("expected output to contain %#v; got:\n%s", expected, outputs[0])
+		}
+	}
+}
+
+func TestMapKeyErrorFiltered(t *testing.T) {
+	root1 := writeTree(t, map[string]string{"a": "1", "d/x.crc": "1"})
+	root2 := writeTree(t, map[string]string{"a": "1"})
+
+	// The subprefix can't be mapped in a delimited listing, but has no keys to compare.
+	output, summary := compareTrees(t, root1, root2, func(s3c *S3Comparer) {
+		if err := s3c.MapKey("s|^d/|e/x/|"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s3c.Exclude("*.crc"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if !summary.Identical() {
+		t.Errorf("expected no differences or errors; got %+v:\n%s", summary, output)
+	}
+}
+
+func TestExcludedSubtreeNotListed(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := newMemoryBackend("bucket2")
+
+	for _, key := range []string{"a", "d/e/a", "d/e/b", "d/e/f/a", "d/g.crc"} {
+		backend1.put(key, "1", modified)
+	}
+
+	backend2.put("a", "1", modified)
+
+	output := &bytes.Buffer{}
+	s3c := NewS3Comparer(context.Background(), output, OutputFormatText, backend1, backend2)
+
+	for _, pattern := range []string{"d/e/**", "*.crc"} {
+		if err := s3c.Exclude(pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// d/ is only in the first location, but has no keys to compare, so it isn't reported.
+	if summary := s3c.ComparePrefixes("", ""); !summary.Identical() || output.Len() != 0 {
+		t.Errorf("expected no differences; got %+v:\n%s", summary, output)
+	}
+
+	for _, name := range backend1.listedNames() {
+		if strings.HasPrefix(name, "d/e/") && name != "d/e/" {
+			t.Errorf("expected the excluded subtree not to be listed; got %#v", name)
+		}
+	}
+}
+
+func TestCompareACLsAcrossAccounts(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := newMemoryBackend("bucket2")
+
+	// A copy to another account, which has a different canonical user ID; b lost its public read grant.
+	for _, key := range []string{"a", "b"} {
+		backend1.put(key, "1", modified).acl = &ObjectACL{Owner: "account1", Grants: []ACLGrant{
+			{GranteeType: "id", Grantee: "account1", Permission: "FULL_CONTROL"},
+			{GranteeType: "uri", Grantee: "http://acs.amazonaws.com/groups/global/AllUsers", Permission: "READ"},
+		}}
+
+		acl := &ObjectACL{Owner: "account2", Grants: []ACLGrant{
+			{GranteeType: "id", Grantee: "account2", Permission: "FULL_CONTROL"},
+		}}
+		if key == "a" {
+			acl.Grants = append(acl.Grants,
+				ACLGrant{GranteeType: "uri", Grantee: "http://acs.amazonaws.com/groups/global/AllUsers", Permission: "READ"})
+		}
+
+		backend2.put(key, "1", modified).acl = acl
+	}
+
+	for _, mapped := range []bool{false, true} {
+		s3c := NewS3Comparer(context.Background(), &bytes.Buffer{}, OutputFormatText, backend1, backend2)
+		if err := s3c.CompareACLs(); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]uint64{"x-amz-owner": 2, "x-amz-grant-full-control": 2, "x-amz-grant-read": 1}
+
+		if mapped {
+			s3c.MapACLID("account1", "account2")
+			expected = map[string]uint64{"x-amz-grant-read": 1}
+		}
+
+		if summary := s3c.ComparePrefixes("", ""); !reflect.DeepEqual(summary.MismatchedHeaders, expected) {
+			t.Errorf("mapped=%v: expected mismatched headers %v; got %v", mapped, expected, summary.MismatchedHeaders)
+		}
+	}
+}
+
+// decodeReports decodes JSON output, returning the reports of differences (skipping any summary).
+func decodeReports(t *testing.T, output []byte) []DiffReport {
+	t.Helper()
+
+	var reports []DiffReport
+	if err := json.Unmarshal(output, &reports); err != nil {
+		t.Fatalf("invalid JSON output: %v:\n%s", err, output)
+	}
+
+	diffs := reports[:0]
+
+	for _, dr := range reports {
+		if dr.Type != DiffTypeSummary {
+			diffs = append(diffs, dr)
+		}
+	}
+
+	return diffs
+}
+
+func TestCompareVersionHistories(t *testing.T) {
+	start := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := newMemoryBackend("bucket2")
+
+	for i, contents := range []string{"1", "2"} {
+		backend1.put("d/same", contents, start.Add(time.Duration(i)*time.Hour))
+		backend2.put("d/same", contents, start.Add(time.Duration(i)*time.Hour))
+	}
+
+	backend1.put("d/diverged", "1", start)
+	backend1.put("d/diverged", "2", start.Add(time.Hour))
+	backend2.put("d/diverged", "1", start)
+	backend2.put("d/diverged", "3", start.Add(time.Hour))
+	backend2.put("d/diverged", "3", start.Add(2*time.Hour))
+
+	// Deleted in both, so the latest versions aren't compared.
+	backend1.put("d/deleted", "1", start)
+	backend1.remove("d/deleted", start.Add(time.Hour))
+	backend2.put("d/deleted", "1", start)
+	backend2.remove("d/deleted", start.Add(time.Hour))
+
+	// Only in the first location: a key with only a delete marker, and keys with versions (even if deleted).
+	backend1.remove("d/removed", start)
+	backend1.put("d/missing", "1", start)
+	backend1.put("d/missing-deleted", "1", start)
+	backend1.remove("d/missing-deleted", start.Add(time.Hour))
+
+	expected := map[string]bool{
+		"VersionMismatch d/diverged": true,
+		"Mismatch d/diverged":        true,
+		"DeleteMarker d/removed":     true,
+		"Missing d/missing":          true,
+		"Missing d/missing-deleted":  true,
+	}
+
+	for _, flat := range []bool{false, true} {
+		output := &bytes.Buffer{}
+		s3c := NewS3Comparer(context.Background(), output, OutputFormatJSON, backend1, backend2)
+
+		if err := s3c.CompareVersions(); err != nil {
+			t.Fatal(err)
+		}
+
+		if flat {
+			s3c.FlatListing()
+		}
+
+		s3c.ComparePrefixes("", "")
+
+		found := make(map[string]bool)
+
+		for _, dr := range decodeReports(t, output.Bytes()) {
+			found[string(dr.Type)+" "+strings.TrimPrefix(dr.Objects[FirstObject].URL, "mem://bucket1/")] = true
+
+			if dr.Type != DiffTypeVersionMismatch {
+				continue
+			}
+
+			// The latest versions are identified, and only the second and third versions differ.
+			if dr.Objects[FirstObject].VersionID != "v2" || dr.Objects[SecondObject].VersionID != "v3" {
+				t.Errorf("flat=%v: expected versions v2 and v3 to be reported; got %+v", flat, dr.Objects)
+			}
+
+			if dr.CommonHeaders["version-0001"] != "size=1 etag=\"c4ca4238a0b923820dcc509a6f75849b\"" ||
+				len(dr.DiffHeaders) != 2 || dr.DiffHeaders["version-0003"][0] != "" {
+				t.Errorf("flat=%v: expected the second and third versions to differ; got %v and %v", flat,
+					dr.CommonHeaders, dr.DiffHeaders)
+			}
+		}
+
+		if !reflect.DeepEqual(found, expected) {
+			t.Errorf("flat=%v: expected reports %v; got %v:\n%s", flat, expected, found, output)
+		}
+	}
+}
+
+func TestListOnly(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		compareHeader string
+		mismatched    []string
+		examined      []string
+	}{
+		{name: "listings alone", mismatched: []string{"content-length", "etag"}, examined: []string{"c"}},
+		{
+			name:          "header requested",
+			compareHeader: "Content-Type",
+			mismatched:    []string{"content-length", "content-type", "etag"},
+			examined:      []string{"a", "b", "c"},
+		},
+	}
+
+	for _, test := range tests {
+		backend1 := newMemoryBackend("bucket1")
+		backend2 := newMemoryBackend("bucket2")
+
+		// b differs only in a header that isn't listed, and c in its size.
+		backend1.put("a", "1", modified)
+		backend2.put("a", "1", modified)
+		backend1.put("b", "1", modified).headers["content-type"] = "text/plain"
+		backend2.put("b", "1", modified).headers["content-type"] = "text/html"
+		backend1.put("c", "1", modified)
+		backend2.put("c", "22", modified)
+
+		s3c := NewS3Comparer(context.Background(), &bytes.Buffer{}, OutputFormatText, backend1, backend2)
+		s3c.ListOnly()
+
+		if test.compareHeader != "" {
+			s3c.CompareHeader(test.compareHeader)
+		}
+
+		summary := s3c.ComparePrefixes("", "")
+
+		mismatched := make([]string, 0, len(summary.MismatchedHeaders))
+		for header := range summary.MismatchedHeaders {
+			mismatched = append(mismatched, header)
+		}
+
+		sort.Strings(mismatched)
+
+		if !reflect.DeepEqual(mismatched, test.mismatched) {
+			t.Errorf("%s: expected mismatched headers %v; got %v", test.name, test.mismatched, mismatched)
+		}
+
+		for _, backend := range []*memoryBackend{backend1, backend2} {
+			sort.Strings(backend.stats)
+
+			if !reflect.DeepEqual(backend.stats, test.examined) {
+				t.Errorf("%s: expected %v to be examined in %s; got %v", test.name, test.examined, backend.name,
+					backend.stats)
+			}
+		}
+	}
+}
+
+func TestErrorReports(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := newMemoryBackend("bucket2")
+
+	for _, key := range []string{"a", "b"} {
+		backend1.put(key, "1", modified)
+		backend2.put(key, "1", modified)
+	}
+
+	// Not retryable, so it's reported at once.
+	backend2.errors = map[string]error{"b": &testAPIError{code: "AccessDenied"}}
+
+	for _, format := range []OutputFormat{OutputFormatText, OutputFormatJSON} {
+		output := &bytes.Buffer{}
+		s3c := NewS3Comparer(context.Background(), output, format, backend1, backend2)
+		summary := s3c.ComparePrefixes("", "")
+
+		if summary.Compared != 2 || summary.Errored != 1 || summary.Identical() {
+			t.Errorf("format %d: expected both keys compared, with one error; got %+v:\n%s", format, summary, output)
+		}
+
+		if format == OutputFormatText {
+			expected := "Error: HeadObject on mem://bucket2/b?versionId=v1 failed: AccessDenied: AccessDenied\n"
+			if output.String() != expected {
+				t.Errorf("expected %#v; got %#v", expected, output.String())
+			}
+
+			continue
+		}
+
+		reports := decodeReports(t, output.Bytes())
+		expected := DiffReport{
+			Type:    DiffTypeError,
+			Objects: []DiffObject{{}, {URL: "mem://bucket2/b", VersionID: "v1"}},
+			Error:   &DiffError{Operation: "HeadObject", Code: "AccessDenied", Message: "AccessDenied"},
+		}
+
+		if len(reports) != 1 || !reflect.DeepEqual(reports[0], expected) {
+			t.Errorf("expected only %+v; got %+v", expected, reports)
+		}
+	}
+}
+
+func TestListingErrorReports(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := newMemoryBackend("bucket2")
+
+	for _, key := range []string{"a", "d/b", "e/c"} {
+		backend1.put(key, "1", modified)
+		backend2.put(key, "1", modified)
+	}
+
+	backend1.errors = map[string]error{"d/": &testAPIError{code: "AccessDenied"}}
+
+	output := &bytes.Buffer{}
+	s3c := NewS3Comparer(context.Background(), output, OutputFormatText, backend1, backend2)
+	summary := s3c.ComparePrefixes("", "")
+
+	// The rest of the tree is still compared, and the keys of the directory that couldn't be listed aren't reported
+	// as missing.
+	expected := "Error: ListObjects on mem://bucket1/d/ failed: AccessDenied: AccessDenied\n"
+	if output.String() != expected || summary.Compared != 2 || summary.Errored != 1 {
+		t.Errorf("expected %#v with two keys compared; got %#v (%+v)", expected, output.String(), summary)
+	}
+}
+
+func TestNDJSONOutput(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := newMemoryBackend("bucket2")
+
+	for i := 0; i < 5; i++ {
+		backend1.put(fmt.Sprintf("k%d", i), "1", modified)
+		backend2.put(fmt.Sprintf("k%d", i), "2", modified)
+	}
+
+	backend1.put("d/a", "1", modified)
+
+	output := &bytes.Buffer{}
+	s3c := NewS3Comparer(context.Background(), output, OutputFormatNDJSON, backend1, backend2)
+	s3c.PrintSummary()
+	s3c.ComparePrefixes("", "")
+
+	// Each line is a complete object, so any prefix of the output is valid.
+	lines := strings.Split(output.String(), "\n")
+	if last := lines[len(lines)-1]; last != "" {
+		t.Fatalf("expected the output to end with a newline; got %#v", last)
+	}
+
+	lines = lines[:len(lines)-1]
+	types := make(map[DiffType]int)
+
+	for i, line := range lines {
+		var dr DiffReport
+		if err := json.Unmarshal([]byte(line), &dr); err != nil {
+			t.Fatalf("line %d: invalid JSON %#v: %v", i+1, line, err)
+		}
+
+		types[dr.Type]++
+
+		if dr.Type == DiffTypeSummary && i != len(lines)-1 {
+			t.Errorf("expected the summary on the last line; found it on line %d of %d", i+1, len(lines))
+		}
+	}
+
+	expected := map[DiffType]int{DiffTypeMismatch: 5, DiffTypeMissing: 1, DiffTypeSummary: 1}
+	if !reflect.DeepEqual(types, expected) {
+		t.Errorf("expected reports %v; got %v:\n%s", expected, types, output)
+	}
+
+	// With no differences and no summary, nothing is written.
+	output.Reset()
+	s3c = NewS3Comparer(context.Background(), output, OutputFormatNDJSON, backend1, backend1)
+	s3c.ComparePrefixes("", "")
+
+	if output.Len() != 0 {
+		t.Errorf("expected no output; got %#v", output.String())
+	}
+}
+
+// multipartMemoryBackend is a memoryBackend whose objects appear to have been uploaded in parts of partSize bytes.
+type multipartMemoryBackend struct {
+	*memoryBackend
+	partSize int64
+}
+
+func (mmb *multipartMemoryBackend) StatObject(ctx context.Context, key, versionID string) (*ObjectInfo, error) {
+	info, err := mmb.memoryBackend.StatObject(ctx, key, versionID)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := mmb.version(key, versionID)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Headers["etag"], err = computeMultipartETag(strings.NewReader(version.contents), mmb.partSize)
+
+	return info, err
+}
+
+func (mmb *multipartMemoryBackend) PartLayout(ctx context.Context, key, versionID string) (int64, int, error) {
+	version, err := mmb.version(key, versionID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return mmb.partSize, (len(version.contents) + int(mmb.partSize) - 1) / int(mmb.partSize), nil
+}
+
+func TestMultipartETagsCounted(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := &multipartMemoryBackend{memoryBackend: newMemoryBackend("bucket2"), partSize: 4}
+
+	backend1.put("same", "0123456789", modified)
+	backend2.put("same", "0123456789", modified)
+	backend1.put("typed", "0123456789", modified).headers["content-type"] = "text/plain"
+	backend2.put("typed", "0123456789", modified).headers["content-type"] = "application/json"
+
+	output := &bytes.Buffer{}
+	s3c := NewS3Comparer(context.Background(), output, OutputFormatText, backend1, backend2)
+	s3c.MultipartETags()
+
+	// Both keys' ETags are equivalent, but only the key whose content type differs is reported.
+	summary := s3c.ComparePrefixes("", "")
+
+	if summary.Mismatched != 1 || !reflect.DeepEqual(summary.MismatchedHeaders, map[string]uint64{"content-type": 1}) ||
+		!reflect.DeepEqual(summary.EquivalentHeaders, map[string]uint64{"etag": 2}) {
+		t.Errorf("expected one mismatch and two equivalent ETags; got %+v:\n%s", summary, output)
+	}
+
+	if !strings.Contains(output.String(), "\\ etag equivalent: multipart ETag recomputed from mem://bucket1/typed") {
+		t.Errorf("expected the report to note the equivalence; got:\n%s", output)
+	}
+}
@@ -0,0 +1,158 @@
+package s3compare
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// listShards lists the rest of a listing of prefix, following the key after, in parallel shards. The range is split at
+// prefix+c for each shard character c: paginator is continued up to the first boundary, and each following range is
+// listed by a new paginator starting after the boundary. Pages are sent in order.
+//
+// Boundaries are keys one character past the prefix, so no subprefix of a delimited listing spans two shards.
+func (s3ah *asyncS3Handler) listShards(prefix string, versions, recursive bool, paginator ListPaginator, after string,
+	stop <-chan struct{}, pageChan chan<- *asyncListPageResult) {
+	boundaries := shardBoundaries(prefix, after, s3ah.shardChars)
+
+	// Stop the shards if we return early.
+	shardStop := make(chan struct{})
+	defer close(shardStop)
+
+	shardChans := make([]chan *asyncListPageResult, 0, len(boundaries)+1)
+
+	for i := 0; i <= len(boundaries); i++ {
+		shardPaginator := paginator
+
+		if i > 0 {
+			var err error
+
+			shardPaginator, err = s3ah.newListPaginator(prefix, versions, recursive, boundaries[i-1])
+			if err != nil {
+				s3ah.sendPage(pageChan, stop, &asyncListPageResult{Err: err})
+				return
+			}
+		}
+
+		if i < len(boundaries) {
+			shardPaginator = &boundedListPaginator{paginator: shardPaginator, end: boundaries[i]}
+		}
+
+		// Each shard reads at most one page ahead.
+		shardChan := make(chan *asyncListPageResult, 1)
+		shardChans = append(shardChans, shardChan)
+
+		go s3ah.asyncListShard(prefix, shardPaginator, shardStop, shardChan)
+	}
+
+	for _, shardChan := range shardChans {
+		for result := range shardChan {
+			if !s3ah.sendPage(pageChan, stop, result) {
+				return
+			}
+		}
+	}
+}
+
+// asyncListShard sends each page of one shard of a listing, with the prefix removed.
+func (s3ah *asyncS3Handler) asyncListShard(prefix string, paginator ListPaginator, stop <-chan struct{},
+	pageChan chan<- *asyncListPageResult) {
+	defer close(pageChan)
+
+	for paginator.HasMorePages() {
+		page, err := s3ah.nextPage(prefix, paginator)
+		if !s3ah.sendPage(pageChan, stop, &asyncListPageResult{Page: page, Err: err}) {
+			return
+		}
+	}
+}
+
+// shardBoundaries returns prefix+c for each character c in chars (which must be sorted) where that follows after.
+func shardBoundaries(prefix, after, chars string) []string {
+	var boundaries []string
+
+	for _, c := range chars {
+		if boundary := prefix + string(c); boundary > after {
+			boundaries = append(boundaries, boundary)
+		}
+	}
+
+	return boundaries
+}
+
+// sortedShardChars returns the distinct characters of chars in key order.
+func sortedShardChars(chars string) string {
+	distinct := make(map[string]bool)
+
+	for _, c := range chars {
+		distinct[string(c)] = true
+	}
+
+	sorted := make([]string, 0, len(distinct))
+	for c := range distinct {
+		sorted = append(sorted, c)
+	}
+
+	sort.Strings(sorted)
+
+	return strings.Join(sorted, "")
+}
+
+// lastListed returns the greatest subprefix or key in a page, or "" if the page is empty.
+func lastListed(page *ListPage) string {
+	var last string
+
+	if len(page.Subprefixes) > 0 {
+		last = page.Subprefixes[len(page.Subprefixes)-1]
+	}
+
+	if len(page.Objects) > 0 && page.Objects[len(page.Objects)-1].Key > last {
+		last = page.Objects[len(page.Objects)-1].Key
+	}
+
+	return last
+}
+
+// boundedListPaginator ends a listing after the given key.
+type boundedListPaginator struct {
+	paginator ListPaginator
+	end       string
+	done      bool
+}
+
+func (blp *boundedListPaginator) HasMorePages() bool {
+	return !blp.done && blp.paginator.HasMorePages()
+}
+
+// makesOwnCalls indicates whether the paginator being bounded makes its own calls.
+func (blp *boundedListPaginator) makesOwnCalls() bool {
+	selfCalling, ok := blp.paginator.(selfCallingListPaginator)
+	return ok && selfCalling.makesOwnCalls()
+}
+
+func (blp *boundedListPaginator) NextPage(ctx context.Context) (*ListPage, error) {
+	page, err := blp.paginator.NextPage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ListPage{}
+
+	for _, subprefix := range page.Subprefixes {
+		if subprefix > blp.end {
+			blp.done = true
+		} else {
+			result.Subprefixes = append(result.Subprefixes, subprefix)
+		}
+	}
+
+	for _, obj := range page.Objects {
+		if obj.Key > blp.end {
+			blp.done = true
+		} else {
+			result.Objects = append(result.Objects, obj)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,114 @@
+package s3compare
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Summary counts the results of a comparison.
+//
+// Prefixes is the number of pairs of prefixes listed and compared (just one with FlatListing), and Compared the number
+// of keys found in both locations (and so compared). Bytes1 and Bytes2 are the total sizes of the keys compared in each
+// location.
+//
+// OnlyIn1 and OnlyIn2 are the number of Missing and DeleteMarker reports of keys found only in the first or second
+// location, each of which may be of a whole subprefix. Mismatched is the number of Mismatch, ContentMismatch, and
+// VersionMismatch reports (a key may have more than one), and MismatchedHeaders the number of those reports in which
+// each header differed. EquivalentHeaders is the number of keys compared in which each header differed but its values
+// were found to be equivalent (see S3Comparer.MultipartETags), whether or not the key was reported. Errored is the
+// number of Error reports.
+//
+// Calls1 and Calls2 are the number of calls made to each location, including retries. ElapsedSeconds is the time taken
+// by the comparison.
+type Summary struct {
+	Prefixes          uint64            `json:"Prefixes"`
+	Compared          uint64            `json:"Compared"`
+	OnlyIn1           uint64            `json:"OnlyIn1"`
+	OnlyIn2           uint64            `json:"OnlyIn2"`
+	Mismatched        uint64            `json:"Mismatched"`
+	MismatchedHeaders map[string]uint64 `json:"MismatchedHeaders"`
+	EquivalentHeaders map[string]uint64 `json:"EquivalentHeaders,omitempty"`
+	Errored           uint64            `json:"Errored"`
+	Bytes1            uint64            `json:"Bytes1"`
+	Bytes2            uint64            `json:"Bytes2"`
+	Calls1            uint64            `json:"Calls1"`
+	Calls2            uint64            `json:"Calls2"`
+	ElapsedSeconds    float64           `json:"ElapsedSeconds"`
+}
+
+// Identical indicates whether no differences or errors were found.
+func (s *Summary) Identical() bool {
+	return s.OnlyIn1 == 0 && s.OnlyIn2 == 0 && s.Mismatched == 0 && s.Errored == 0
+}
+
+// countDiff counts a report of the given type, with the object in the given position for Missing and DeleteMarker
+// reports.
+func (s *Summary) countDiff(diffType DiffType, position DiffObjectPosition) {
+	switch diffType {
+	case DiffTypeMissing, DiffTypeDeleteMarker:
+		if position == FirstObject {
+			atomic.AddUint64(&s.OnlyIn1, 1)
+		} else {
+			atomic.AddUint64(&s.OnlyIn2, 1)
+		}
+	case DiffTypeError:
+		atomic.AddUint64(&s.Errored, 1)
+	default:
+		atomic.AddUint64(&s.Mismatched, 1)
+	}
+}
+
+// snapshot returns a copy of the counts, which may be updated concurrently, except for MismatchedHeaders and
+// EquivalentHeaders, which are left for the caller to copy.
+func (s *Summary) snapshot() Summary {
+	return Summary{
+		Prefixes:   atomic.LoadUint64(&s.Prefixes),
+		Compared:   atomic.LoadUint64(&s.Compared),
+		OnlyIn1:    atomic.LoadUint64(&s.OnlyIn1),
+		OnlyIn2:    atomic.LoadUint64(&s.OnlyIn2),
+		Mismatched: atomic.LoadUint64(&s.Mismatched),
+		Errored:    atomic.LoadUint64(&s.Errored),
+		Bytes1:     atomic.LoadUint64(&s.Bytes1),
+		Bytes2:     atomic.LoadUint64(&s.Bytes2),
+	}
+}
+
+// text returns the summary as lines of text beginning with "Summary:", given the URLs of the prefixes compared.
+func (s *Summary) text(url1, url2 string) string {
+	sb := &strings.Builder{}
+
+	fmt.Fprintf(sb, "Summary: %d prefixes and %d keys compared in %.3fs\n", s.Prefixes, s.Compared, s.ElapsedSeconds)
+	fmt.Fprintf(sb, "Summary: only in %s: %d\n", url1, s.OnlyIn1)
+	fmt.Fprintf(sb, "Summary: only in %s: %d\n", url2, s.OnlyIn2)
+	fmt.Fprintf(sb, "Summary: mismatched: %d\n", s.Mismatched)
+
+	for _, header := range sortedHeaders(s.MismatchedHeaders) {
+		fmt.Fprintf(sb, "Summary: mismatched %s: %d\n", header, s.MismatchedHeaders[header])
+	}
+
+	for _, header := range sortedHeaders(s.EquivalentHeaders) {
+		fmt.Fprintf(sb, "Summary: equivalent %s: %d\n", header, s.EquivalentHeaders[header])
+	}
+
+	fmt.Fprintf(sb, "Summary: errors: %d\n", s.Errored)
+	fmt.Fprintf(sb, "Summary: bytes compared in %s: %d\n", url1, s.Bytes1)
+	fmt.Fprintf(sb, "Summary: bytes compared in %s: %d\n", url2, s.Bytes2)
+	fmt.Fprintf(sb, "Summary: calls to %s: %d\n", url1, s.Calls1)
+	fmt.Fprintf(sb, "Summary: calls to %s: %d\n", url2, s.Calls2)
+
+	return sb.String()
+}
+
+// sortedHeaders returns the headers counted in counts, in order.
+func sortedHeaders(counts map[string]uint64) []string {
+	headers := make([]string, 0, len(counts))
+	for header := range counts {
+		headers = append(headers, header)
+	}
+
+	sort.Strings(headers)
+
+	return headers
+}
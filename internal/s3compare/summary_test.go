@@ -0,0 +1,162 @@
+package s3compare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummaryIdentical(t *testing.T) {
+	tests := []struct {
+		diffType  DiffType
+		position  DiffObjectPosition
+		different Summary
+	}{
+		{diffType: DiffTypeMissing, position: FirstObject, different: Summary{OnlyIn1: 1}},
+		{diffType: DiffTypeDeleteMarker, position: SecondObject, different: Summary{OnlyIn2: 1}},
+		{diffType: DiffTypeMismatch, different: Summary{Mismatched: 1}},
+		{diffType: DiffTypeContentMismatch, different: Summary{Mismatched: 1}},
+		{diffType: DiffTypeVersionMismatch, different: Summary{Mismatched: 1}},
+		{diffType: DiffTypeError, position: SecondObject, different: Summary{Errored: 1}},
+	}
+
+	for _, test := range tests {
+		// Keys compared and calls made don't count as differences.
+		summary := Summary{Prefixes: 3, Compared: 2, Bytes1: 10, Calls1: 4}
+		if !summary.Identical() {
+			t.Fatalf("expected %+v to be identical", summary)
+		}
+
+		summary = Summary{}
+		summary.countDiff(test.diffType, test.position)
+
+		if !reflect.DeepEqual(summary, test.different) {
+			t.Errorf("%s: got %+v; expected %+v", test.diffType, summary, test.different)
+		}
+
+		if summary.Identical() {
+			t.Errorf("%s: expected %+v not to be identical", test.diffType, summary)
+		}
+	}
+}
+
+func TestCompareSummaryCounts(t *testing.T) {
+	root1 := writeTree(t, map[string]string{"a": "1", "b": "12", "d/c": "123", "d/e/f": "1", "only1/x": "1"})
+	root2 := writeTree(t, map[string]string{"a": "1", "b": "21", "d/c": "1234", "only2": "1"})
+
+	_, summary := compareTrees(t, root1, root2, nil)
+
+	// The time taken and calls made vary.
+	summary.ElapsedSeconds = 0
+	summary.Calls1 = 0
+	summary.Calls2 = 0
+
+	// Each directory only in the first location (only1/ and d/e/) is a single report.
+	expected := Summary{
+		Prefixes:          2,
+		Compared:          3,
+		OnlyIn1:           2,
+		OnlyIn2:           1,
+		Mismatched:        2,
+		MismatchedHeaders: map[string]uint64{"content-length": 1, "etag": 2},
+		Bytes1:            6,
+		Bytes2:            7,
+	}
+
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("got %+v; expected %+v", summary, expected)
+	}
+
+	// The summary doesn't depend on the output written.
+	s3c := NewS3Comparer(context.Background(), io.Discard, OutputFormatText, NewLocalBackend(root1),
+		NewLocalBackend(root2))
+
+	if quiet := s3c.ComparePrefixes("", ""); quiet.Identical() || quiet.Mismatched != expected.Mismatched {
+		t.Errorf("expected the same differences without output; got %+v", quiet)
+	}
+}
+
+func TestSummaryText(t *testing.T) {
+	summary := Summary{
+		Prefixes:          4,
+		Compared:          10,
+		OnlyIn1:           1,
+		OnlyIn2:           2,
+		Mismatched:        3,
+		MismatchedHeaders: map[string]uint64{"etag": 3, "content-length": 1},
+		EquivalentHeaders: map[string]uint64{"etag": 2},
+		Errored:           1,
+		Bytes1:            100,
+		Bytes2:            200,
+		Calls1:            12,
+		Calls2:            14,
+		ElapsedSeconds:    1.5,
+	}
+
+	expected := `Summary: 4 prefixes and 10 keys compared in 1.500s
+Summary: only in s3://a/x/: 1
+Summary: only in s3://b/y/: 2
+Summary: mismatched: 3
+Summary: mismatched content-length: 1
+Summary: mismatched etag: 3
+Summary: equivalent etag: 2
+Summary: errors: 1
+Summary: bytes compared in s3://a/x/: 100
+Summary: bytes compared in s3://b/y/: 200
+Summary: calls to s3://a/x/: 12
+Summary: calls to s3://b/y/: 14
+`
+
+	if text := summary.text("s3://a/x/", "s3://b/y/"); text != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", text, expected)
+	}
+}
+
+func TestPrintSummary(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := newMemoryBackend("bucket2")
+
+	backend1.put("src/a", "1", modified)
+	backend1.put("src/b", "1", modified)
+	backend2.put("dst/a", "22", modified)
+
+	// Text output ends with the summary, following the differences.
+	output := &bytes.Buffer{}
+	s3c := NewS3Comparer(context.Background(), output, OutputFormatText, backend1, backend2)
+	s3c.PrintSummary()
+	s3c.ComparePrefixes("src/", "dst/")
+
+	text := output.String()
+	if summaryStart := strings.Index(text, "Summary: "); summaryStart < 0 ||
+		!strings.Contains(text[:summaryStart], "Only in mem://bucket1/src/: b\n") ||
+		!strings.HasSuffix(text, "Summary: calls to mem://bucket2/dst/: 2\n") {
+		t.Errorf("expected the differences followed by the summary; got:\n%s", text)
+	}
+
+	// In JSON output, it's the last element of the array.
+	output = &bytes.Buffer{}
+	s3c = NewS3Comparer(context.Background(), output, OutputFormatJSON, backend1, backend2)
+	s3c.PrintSummary()
+	s3c.ComparePrefixes("src/", "dst/")
+
+	var elements []json.RawMessage
+	if err := json.Unmarshal(output.Bytes(), &elements); err != nil {
+		t.Fatalf("invalid JSON output: %v:\n%s", err, output)
+	}
+
+	var last summaryReport
+	if err := json.Unmarshal(elements[len(elements)-1], &last); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(elements) != 3 || last.Type != DiffTypeSummary || last.Summary == nil || last.Summary.Compared != 1 ||
+		last.Summary.OnlyIn1 != 1 || last.Summary.MismatchedHeaders["etag"] != 1 || last.Summary.Bytes2 != 2 {
+		t.Errorf("expected a mismatch and a missing key followed by the summary; got:\n%s", output)
+	}
+}
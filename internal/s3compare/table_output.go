@@ -0,0 +1,120 @@
+package s3compare
+
+import (
+	"bytes"
+	"encoding/csv"
+	"sort"
+	"strings"
+)
+
+// tableColumns are the columns of CSV and TSV output preceding those for the values of each differing header.
+var tableColumns = []string{"Type", "Url1", "Url2", "LastModified1", "LastModified2", "DiffHeaders", "Error"}
+
+// writeTable writes the reports held as CSV or TSV, with a row for each report following a header row. After the
+// fixed columns (tableColumns), there are two columns for each header that differs in any report, "<header> (1)" and
+// "<header> (2)", in order of header name, holding its values in each location.
+func (s3c *S3Comparer) writeTable() error {
+	s3c.outputMutex.Lock()
+	defer s3c.outputMutex.Unlock()
+
+	headerSet := make(map[string]bool)
+
+	for _, dr := range s3c.heldReports {
+		for header := range dr.DiffHeaders {
+			headerSet[header] = true
+		}
+	}
+
+	headers := make([]string, 0, len(headerSet))
+	for header := range headerSet {
+		headers = append(headers, header)
+	}
+
+	sort.Strings(headers)
+
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+
+	if s3c.outputFormat == OutputFormatTSV {
+		w.Comma = '\t'
+	}
+
+	columns := append([]string{}, tableColumns...)
+	for _, header := range headers {
+		columns = append(columns, header+" (1)", header+" (2)")
+	}
+
+	if err := w.Write(escapeFormulas(columns)); err != nil {
+		return err
+	}
+
+	for _, dr := range s3c.heldReports {
+		if err := w.Write(escapeFormulas(tableRow(dr, headers))); err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+
+	if err := w.Error(); err != nil {
+		return err
+	}
+
+	return s3c.write(buf.Bytes())
+}
+
+// formulaPrefixes are the characters that cause spreadsheets to treat a cell beginning with them as a formula.
+const formulaPrefixes = "=+-@\t\r"
+
+// escapeFormulas prefixes each cell that a spreadsheet would treat as a formula with "'", so that keys and header
+// values (which may be chosen by anyone who can write to a bucket) are shown as text rather than evaluated. The row is
+// modified in place and returned.
+func escapeFormulas(row []string) []string {
+	for i, cell := range row {
+		if cell != "" && strings.IndexByte(formulaPrefixes, cell[0]) >= 0 {
+			row[i] = "'" + cell
+		}
+	}
+
+	return row
+}
+
+// tableRow returns the row for a report, given the headers that have columns.
+func tableRow(dr *DiffReport, headers []string) []string {
+	diffHeaders := make([]string, 0, len(dr.DiffHeaders))
+	for header := range dr.DiffHeaders {
+		diffHeaders = append(diffHeaders, header)
+	}
+
+	sort.Strings(diffHeaders)
+
+	var errorText string
+	if dr.Error != nil {
+		errorText = dr.Error.Operation + ": "
+		if dr.Error.Code != "" {
+			errorText += dr.Error.Code + ": "
+		}
+
+		errorText += dr.Error.Message
+	}
+
+	row := []string{
+		string(dr.Type),
+		dr.Objects[FirstObject].displayName(),
+		dr.Objects[SecondObject].displayName(),
+		dr.Objects[FirstObject].LastModified,
+		dr.Objects[SecondObject].LastModified,
+		strings.Join(diffHeaders, ";"),
+		errorText,
+	}
+
+	for _, header := range headers {
+		if values, found := dr.DiffHeaders[header]; found {
+			row = append(row, values[0], values[1])
+		} else {
+			row = append(row, "", "")
+		}
+	}
+
+	return row
+}
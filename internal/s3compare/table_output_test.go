@@ -0,0 +1,126 @@
+package s3compare
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTableRow(t *testing.T) {
+	dr := &DiffReport{
+		Type: DiffTypeMismatch,
+		Objects: []DiffObject{
+			{URL: "s3://a/k", VersionID: "v1", LastModified: "2026-09-01T00:00:00Z"},
+			{URL: "s3://b/k", LastModified: "2026-09-02T00:00:00Z"},
+		},
+		DiffHeaders: map[string][]string{"etag": {`"1"`, `"2"`}, "content-type": {"text/plain", ""}},
+	}
+
+	expected := []string{
+		"Mismatch", "s3://a/k?versionId=v1", "s3://b/k", "2026-09-01T00:00:00Z", "2026-09-02T00:00:00Z",
+		"content-type;etag", "", "", "", "text/plain", "", `"1"`, `"2"`,
+	}
+
+	if row := tableRow(dr, []string{"content-length", "content-type", "etag"}); !reflect.DeepEqual(row, expected) {
+		t.Errorf("got %#v; expected %#v", row, expected)
+	}
+
+	dr = &DiffReport{
+		Type:    DiffTypeError,
+		Objects: []DiffObject{{}, {URL: "s3://b/d/"}},
+		Error:   &DiffError{Operation: "ListObjects", Code: "AccessDenied", Message: "Access Denied"},
+	}
+
+	expected = []string{"Error", "", "s3://b/d/", "", "", "", "ListObjects: AccessDenied: Access Denied", "", ""}
+
+	if row := tableRow(dr, []string{"etag"}); !reflect.DeepEqual(row, expected) {
+		t.Errorf("got %#v; expected %#v", row, expected)
+	}
+}
+
+func TestTableOutputLayout(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := newMemoryBackend("bucket2")
+
+	backend1.put("a", "1", modified).headers["content-type"] = `text/plain; charset="utf-8"`
+	backend2.put("a", "1", modified).headers["content-type"] = "text/plain"
+	backend1.put("b", "1", modified).headers["cache-control"] = "a\tb"
+	backend2.put("b", "1", modified).headers["cache-control"] = "line1\nline2"
+	backend1.put("c", "1", modified)
+
+	expected := []string{
+		`Type,Url1,Url2,LastModified1,LastModified2,DiffHeaders,Error,cache-control (1),cache-control (2),` +
+			`content-type (1),content-type (2)`,
+		`Mismatch,mem://bucket1/a?versionId=v1,mem://bucket2/a?versionId=v1,2026-09-01T00:00:00Z,` +
+			`2026-09-01T00:00:00Z,content-type,,,,"text/plain; charset=""utf-8""",text/plain`,
+		`Mismatch,mem://bucket1/b?versionId=v1,mem://bucket2/b?versionId=v1,2026-09-01T00:00:00Z,` +
+			`2026-09-01T00:00:00Z,cache-control,,a	b,"line1`,
+		`line2",,`,
+		`Missing,mem://bucket1/c?versionId=v1,,,,,,,,,`,
+	}
+
+	// Rows are written in the order the reports were made, which varies, so compare the sorted lines.
+	output := &bytes.Buffer{}
+	s3c := NewS3Comparer(context.Background(), output, OutputFormatCSV, backend1, backend2)
+	s3c.ComparePrefixes("", "")
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	sort.Strings(lines[1:])
+	sort.Strings(expected[1:])
+
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("got:\n%s\nexpected:\n%s", strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestTableOutputEscapesFormulas(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := newMemoryBackend("bucket2")
+
+	backend1.put("a", "1", modified).headers["x-amz-meta-note"] = `=HYPERLINK("http://example.com/","x")`
+	backend2.put("a", "1", modified).headers["x-amz-meta-note"] = "-2+3"
+
+	for name, format := range map[string]OutputFormat{"csv": OutputFormatCSV, "tsv": OutputFormatTSV} {
+		output := &bytes.Buffer{}
+		s3c := NewS3Comparer(context.Background(), output, format, backend1, backend2)
+		s3c.ComparePrefixes("", "")
+
+		r := csv.NewReader(output)
+		if format == OutputFormatTSV {
+			r.Comma = '\t'
+		}
+
+		rows, err := r.ReadAll()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if len(rows) != 2 {
+			t.Fatalf("%s: expected a header row and one report; got %#v", name, rows)
+		}
+
+		columns := make(map[string]string)
+		for i, column := range rows[0] {
+			columns[column] = rows[1][i]
+		}
+
+		if note := columns["x-amz-meta-note (1)"]; note != `'=HYPERLINK("http://example.com/","x")` {
+			t.Errorf("%s: expected the first value to be escaped; got %#v", name, note)
+		}
+
+		if note := columns["x-amz-meta-note (2)"]; note != "'-2+3" {
+			t.Errorf("%s: expected the second value to be escaped; got %#v", name, note)
+		}
+
+		if typ := columns["Type"]; typ != string(DiffTypeMismatch) {
+			t.Errorf("%s: expected a mismatch; got %#v", name, typ)
+		}
+	}
+}
@@ -2,10 +2,20 @@ package s3compare
 
 import (
 	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	s3URLPrefix   = "s3://"
+	fileURLPrefix = "file://"
 )
 
 func headObjectOutputToHeaders(hoo *s3.HeadObjectOutput) map[string]string {
@@ -37,6 +47,43 @@ func headObjectOutputToHeaders(hoo *s3.HeadObjectOutput) map[string]string {
 		headers["etag"] = etag
 	}
 
+	if hoo.Expires != nil {
+		headers["expires"] = hoo.Expires.UTC().Format(http.TimeFormat)
+	}
+
+	if websiteRedirectLocation := aws.ToString(hoo.WebsiteRedirectLocation); websiteRedirectLocation != "" {
+		headers["x-amz-website-redirect-location"] = websiteRedirectLocation
+	}
+
+	// S3 omits the storage class for STANDARD objects.
+	if hoo.StorageClass != "" {
+		headers["x-amz-storage-class"] = string(hoo.StorageClass)
+	}
+
+	if hoo.ServerSideEncryption != "" {
+		headers["x-amz-server-side-encryption"] = string(hoo.ServerSideEncryption)
+	}
+
+	if sseKMSKeyID := aws.ToString(hoo.SSEKMSKeyId); sseKMSKeyID != "" {
+		headers["x-amz-server-side-encryption-aws-kms-key-id"] = sseKMSKeyID
+	}
+
+	if hoo.ObjectLockMode != "" {
+		headers["x-amz-object-lock-mode"] = string(hoo.ObjectLockMode)
+	}
+
+	if hoo.ObjectLockRetainUntilDate != nil {
+		headers["x-amz-object-lock-retain-until-date"] = hoo.ObjectLockRetainUntilDate.UTC().Format(time.RFC3339)
+	}
+
+	if hoo.ObjectLockLegalHoldStatus != "" {
+		headers["x-amz-object-lock-legal-hold"] = string(hoo.ObjectLockLegalHoldStatus)
+	}
+
+	if hoo.ReplicationStatus != "" {
+		headers["x-amz-replication-status"] = string(hoo.ReplicationStatus)
+	}
+
 	if hoo.Metadata != nil {
 		for key, value := range hoo.Metadata {
 			headers[strings.ToLower(fmt.Sprintf("x-amz-meta-%s", key))] = value
@@ -46,6 +93,220 @@ func headObjectOutputToHeaders(hoo *s3.HeadObjectOutput) map[string]string {
 	return headers
 }
 
+// headObjectOutputToChecksums returns the additional checksums reported by HeadObject, if any.
+func headObjectOutputToChecksums(hoo *s3.HeadObjectOutput) map[string]string {
+	checksums := make(map[string]string)
+
+	if crc32 := aws.ToString(hoo.ChecksumCRC32); crc32 != "" {
+		checksums["crc32"] = crc32
+	}
+
+	if crc32c := aws.ToString(hoo.ChecksumCRC32C); crc32c != "" {
+		checksums["crc32c"] = crc32c
+	}
+
+	if sha1 := aws.ToString(hoo.ChecksumSHA1); sha1 != "" {
+		checksums["sha1"] = sha1
+	}
+
+	if sha256 := aws.ToString(hoo.ChecksumSHA256); sha256 != "" {
+		checksums["sha256"] = sha256
+	}
+
+	return checksums
+}
+
+// checksumPreference lists checksum algorithms from most to least preferred for comparison.
+var checksumPreference = []string{"sha256", "sha1", "crc32c", "crc32"}
+
+// addChecksumHeaders adds x-amz-checksum-* headers to each set of headers for every algorithm for which both objects
+// have a full-object checksum. Checksums that can't be compared (because the other object doesn't have one using that
+// algorithm, or either object was uploaded in multiple parts) are omitted. Checksums of multipart uploads ("-N")
+// depend on the part sizes, which HeadObject doesn't report, so identical contents may have different values even if
+// the part counts match.
+func addChecksumHeaders(headers1, headers2 map[string]string, checksums1, checksums2 map[string]string) {
+	for algorithm, value1 := range checksums1 {
+		value2 := checksums2[algorithm]
+
+		if value2 == "" || multipartCount(value1) != 0 || multipartCount(value2) != 0 {
+			continue
+		}
+
+		headers1["x-amz-checksum-"+algorithm] = value1
+		headers2["x-amz-checksum-"+algorithm] = value2
+	}
+}
+
+// commonChecksum returns the preferred algorithm for which both objects have a full-object checksum, or "" if there is
+// none. Checksums of multipart uploads (ending in "-N") depend on the part size and are not used.
+func commonChecksum(checksums1, checksums2 map[string]string) string {
+	for _, algorithm := range checksumPreference {
+		value1 := checksums1[algorithm]
+		value2 := checksums2[algorithm]
+
+		if value1 == "" || value2 == "" || multipartCount(value1) != 0 || multipartCount(value2) != 0 {
+			continue
+		}
+
+		return algorithm
+	}
+
+	return ""
+}
+
+// multipartCount returns the number of parts indicated by an ETag or checksum ending in "-N", or 0 if the value is not
+// from a multipart upload.
+func multipartCount(value string) int {
+	value = strings.Trim(value, "\"")
+
+	dash := strings.LastIndex(value, "-")
+	if dash < 0 {
+		return 0
+	}
+
+	partCount, err := strconv.Atoi(value[dash+1:])
+	if err != nil {
+		return 0
+	}
+
+	return partCount
+}
+
+// tagHeaderPrefix begins the names of the pseudo-headers holding object tags.
+const tagHeaderPrefix = "x-amz-tag-"
+
+// addTagHeaders adds tags to a set of headers as x-amz-tag-<key> pseudo-headers. Tag keys are case-sensitive, so they
+// keep their case.
+func addTagHeaders(headers map[string]string, tags map[string]string) {
+	for key, value := range tags {
+		headers[tagHeaderPrefix+key] = value
+	}
+}
+
+// headerAliases maps other names by which headers have been known (in lowercase) to the names they are compared as.
+// Website-Redirect-Location was documented before it was compared, so it may be given to -ignore-header.
+var headerAliases = map[string]string{
+	"website-redirect-location": "x-amz-website-redirect-location",
+}
+
+// canonicalHeaderName returns the name of a header as it is compared: lowercase, except for the tag key of an
+// x-amz-tag-* pseudo-header, which keeps its case. Aliases are replaced by the header's name.
+func canonicalHeaderName(header string) string {
+	lower := strings.ToLower(header)
+	if strings.HasPrefix(lower, tagHeaderPrefix) {
+		return tagHeaderPrefix + header[len(tagHeaderPrefix):]
+	}
+
+	if name, found := headerAliases[lower]; found {
+		return name
+	}
+
+	return lower
+}
+
+// addACLHeaders adds an ACL to a set of headers as pseudo-headers: x-amz-owner for the owner, and
+// x-amz-grant-<permission> for each permission granted, listing the grantees in the syntax of the S3 grant headers.
+// Canonical user IDs found in idMap are replaced by their mapped value.
+func addACLHeaders(headers map[string]string, acl *ObjectACL, idMap map[string]string) {
+	mapID := func(id string) string {
+		if mapped, found := idMap[id]; found {
+			return mapped
+		}
+
+		return id
+	}
+
+	if acl.Owner != "" {
+		headers["x-amz-owner"] = mapID(acl.Owner)
+	}
+
+	granteesByPermission := make(map[string][]string)
+
+	for _, grant := range acl.Grants {
+		grantee := grant.Grantee
+		if grant.GranteeType == "id" {
+			grantee = mapID(grantee)
+		}
+
+		permission := strings.ToLower(strings.ReplaceAll(grant.Permission, "_", "-"))
+		granteesByPermission[permission] = append(granteesByPermission[permission],
+			fmt.Sprintf("%s=%q", grant.GranteeType, grantee))
+	}
+
+	for permission, grantees := range granteesByPermission {
+		sort.Strings(grantees)
+		headers["x-amz-grant-"+permission] = strings.Join(grantees, ", ")
+	}
+}
+
+// listedObjectHeaders returns the headers that can be determined from a listing: the content length, and the ETag and
+// storage class if the listing included them. As with HeadObject, the STANDARD storage class is omitted.
+func listedObjectHeaders(obj *ListedObject) map[string]string {
+	headers := map[string]string{"content-length": fmt.Sprintf("%d", obj.Size)}
+
+	if obj.ETag != "" {
+		headers["etag"] = obj.ETag
+	}
+
+	if obj.StorageClass != "" && obj.StorageClass != string(types.StorageClassStandard) {
+		headers["x-amz-storage-class"] = obj.StorageClass
+	}
+
+	return headers
+}
+
+// onlyDeleteMarkers indicates whether every listed version of a key is a delete marker.
+func onlyDeleteMarkers(versions []ListedObject) bool {
+	for _, version := range versions {
+		if !version.IsDeleteMarker {
+			return false
+		}
+	}
+
+	return len(versions) > 0
+}
+
+// describeVersion returns a short description of a version's comparable attributes.
+func describeVersion(version ListedObject) string {
+	if version.IsDeleteMarker {
+		return "delete-marker"
+	}
+
+	return fmt.Sprintf("size=%d etag=%s", version.Size, version.ETag)
+}
+
+// copyHeaders returns a shallow copy of a header map so the caller can modify it.
+func copyHeaders(headers map[string]string) map[string]string {
+	result := make(map[string]string, len(headers))
+	for key, value := range headers {
+		result[key] = value
+	}
+
+	return result
+}
+
+// commonDirLen returns the length of the longest common prefix of a and b that ends in "/".
+func commonDirLen(a, b string) int {
+	n := 0
+
+	for i := 0; i < len(a) && i < len(b) && a[i] == b[i]; i++ {
+		if a[i] == '/' {
+			n = i + 1
+		}
+	}
+
+	return n
+}
+
+// optionalString returns a pointer to s, or nil if s is empty, for optional API parameters.
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+
+	return &s
+}
+
 func maxint(a int, b int) int {
 	if a < b {
 		return b
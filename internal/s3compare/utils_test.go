@@ -0,0 +1,205 @@
+package s3compare
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestHeadObjectOutputToHeaders(t *testing.T) {
+	expires := time.Date(2027, 1, 2, 3, 4, 5, 0, time.FixedZone("PST", -8*60*60))
+	retainUntil := time.Date(2030, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	headers := headObjectOutputToHeaders(&s3.HeadObjectOutput{
+		ContentLength:             42,
+		CacheControl:              aws.String("no-cache"),
+		ContentDisposition:        aws.String("attachment"),
+		ContentEncoding:           aws.String("gzip"),
+		ContentLanguage:           aws.String("en"),
+		ContentType:               aws.String("text/plain"),
+		ETag:                      aws.String(`"5eb63bbbe01eeed093cb22bb8f5acdc3"`),
+		Expires:                   &expires,
+		WebsiteRedirectLocation:   aws.String("/index.html"),
+		StorageClass:              types.StorageClassGlacier,
+		ServerSideEncryption:      types.ServerSideEncryptionAwsKms,
+		SSEKMSKeyId:               aws.String("arn:aws:kms:us-west-2:123456789012:key/k"),
+		ObjectLockMode:            types.ObjectLockModeCompliance,
+		ObjectLockRetainUntilDate: &retainUntil,
+		ObjectLockLegalHoldStatus: types.ObjectLockLegalHoldStatusOn,
+		ReplicationStatus:         types.ReplicationStatusComplete,
+		Metadata:                  map[string]string{"Owner": "ops"},
+	})
+
+	expected := map[string]string{
+		"content-length":                  "42",
+		"cache-control":                   "no-cache",
+		"content-disposition":             "attachment",
+		"content-encoding":                "gzip",
+		"content-language":                "en",
+		"content-type":                    "text/plain",
+		"etag":                            `"5eb63bbbe01eeed093cb22bb8f5acdc3"`,
+		"expires":                         "Sat, 02 Jan 2027 11:04:05 GMT",
+		"x-amz-website-redirect-location": "/index.html",
+		"x-amz-storage-class":             "GLACIER",
+		"x-amz-server-side-encryption":    "aws:kms",
+		"x-amz-server-side-encryption-aws-kms-key-id": "arn:aws:kms:us-west-2:123456789012:key/k",
+		"x-amz-object-lock-mode":                      "COMPLIANCE",
+		"x-amz-object-lock-retain-until-date":         "2030-06-01T00:00:00Z",
+		"x-amz-object-lock-legal-hold":                "ON",
+		"x-amz-replication-status":                    "COMPLETE",
+		"x-amz-meta-owner":                            "ops",
+	}
+
+	if !reflect.DeepEqual(headers, expected) {
+		t.Errorf("got %v; expected %v", headers, expected)
+	}
+
+	// Fields S3 omits (such as the storage class of STANDARD objects) aren't reported.
+	if headers := headObjectOutputToHeaders(&s3.HeadObjectOutput{}); !reflect.DeepEqual(headers,
+		map[string]string{"content-length": "0"}) {
+		t.Errorf("got %v for an empty HeadObject output; expected only content-length", headers)
+	}
+}
+
+func TestIgnoreHeaderIndividually(t *testing.T) {
+	modified := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	backend1 := newMemoryBackend("bucket1")
+	backend2 := newMemoryBackend("bucket2")
+
+	object1 := backend1.put("a", "1", modified)
+	object1.headers["x-amz-storage-class"] = "GLACIER"
+	object1.headers["x-amz-object-lock-mode"] = "GOVERNANCE"
+
+	object2 := backend2.put("a", "1", modified)
+	object2.headers["x-amz-object-lock-mode"] = "COMPLIANCE"
+
+	s3c := NewS3Comparer(context.Background(), &bytes.Buffer{}, OutputFormatText, backend1, backend2)
+	s3c.IgnoreHeader("X-Amz-Storage-Class")
+
+	summary := s3c.ComparePrefixes("", "")
+
+	expected := map[string]uint64{"x-amz-object-lock-mode": 1}
+	if !reflect.DeepEqual(summary.MismatchedHeaders, expected) {
+		t.Errorf("expected only the object lock mode to be compared; got %v", summary.MismatchedHeaders)
+	}
+}
+
+func TestAddChecksumHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		checksums1 map[string]string
+		checksums2 map[string]string
+		expected1  map[string]string
+		expected2  map[string]string
+	}{
+		{
+			name:       "full-object checksums",
+			checksums1: map[string]string{"sha256": "a", "crc32": "b"},
+			checksums2: map[string]string{"sha256": "c"},
+			expected1:  map[string]string{"x-amz-checksum-sha256": "a"},
+			expected2:  map[string]string{"x-amz-checksum-sha256": "c"},
+		},
+		{
+			name:       "composite checksums with the same part count",
+			checksums1: map[string]string{"sha256": "a-2"},
+			checksums2: map[string]string{"sha256": "b-2"},
+			expected1:  map[string]string{},
+			expected2:  map[string]string{},
+		},
+		{
+			name:       "one composite checksum",
+			checksums1: map[string]string{"crc32c": "a"},
+			checksums2: map[string]string{"crc32c": "a-3"},
+			expected1:  map[string]string{},
+			expected2:  map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		headers1 := make(map[string]string)
+		headers2 := make(map[string]string)
+
+		addChecksumHeaders(headers1, headers2, test.checksums1, test.checksums2)
+
+		if !reflect.DeepEqual(headers1, test.expected1) || !reflect.DeepEqual(headers2, test.expected2) {
+			t.Errorf("%s: got %v, %v; expected %v, %v", test.name, headers1, headers2, test.expected1, test.expected2)
+		}
+	}
+}
+
+func TestAddTagHeaders(t *testing.T) {
+	headers := make(map[string]string)
+	addTagHeaders(headers, map[string]string{"Env": "a", "env": "b"})
+
+	expected := map[string]string{"x-amz-tag-Env": "a", "x-amz-tag-env": "b"}
+	if !reflect.DeepEqual(headers, expected) {
+		t.Errorf("got %v; expected %v", headers, expected)
+	}
+}
+
+func TestAddACLHeaders(t *testing.T) {
+	acl := &ObjectACL{
+		Owner: "owner1",
+		Grants: []ACLGrant{
+			{GranteeType: "id", Grantee: "owner1", Permission: "FULL_CONTROL"},
+			{GranteeType: "uri", Grantee: "http://acs.amazonaws.com/groups/global/AllUsers", Permission: "READ"},
+			{GranteeType: "id", Grantee: "reader", Permission: "READ"},
+			{GranteeType: "emailAddress", Grantee: "owner1", Permission: "READ_ACP"},
+		},
+	}
+
+	headers := make(map[string]string)
+	addACLHeaders(headers, acl, map[string]string{"owner1": "owner2"})
+
+	// Only canonical user IDs are mapped, and grantees are sorted within each permission.
+	expected := map[string]string{
+		"x-amz-owner":              "owner2",
+		"x-amz-grant-full-control": `id="owner2"`,
+		"x-amz-grant-read":         `id="reader", uri="http://acs.amazonaws.com/groups/global/AllUsers"`,
+		"x-amz-grant-read-acp":     `emailAddress="owner1"`,
+	}
+
+	if !reflect.DeepEqual(headers, expected) {
+		t.Errorf("got %v; expected %v", headers, expected)
+	}
+}
+
+func TestCanonicalHeaderName(t *testing.T) {
+	tests := map[string]string{
+		"Content-Type":     "content-type",
+		"X-Amz-Meta-Owner": "x-amz-meta-owner",
+		"x-amz-tag-Env":    "x-amz-tag-Env",
+		"X-Amz-Tag-Env":    "x-amz-tag-Env",
+
+		"Website-Redirect-Location":       "x-amz-website-redirect-location",
+		"x-amz-website-redirect-location": "x-amz-website-redirect-location",
+	}
+
+	for header, expected := range tests {
+		if name := canonicalHeaderName(header); name != expected {
+			t.Errorf("canonicalHeaderName(%#v): got %#v; expected %#v", header, name, expected)
+		}
+	}
+}
+
+func TestMultipartCount(t *testing.T) {
+	tests := map[string]int{
+		`"df349a9519959b17a605009540f4b31d-3"`: 3,
+		"df349a9519959b17a605009540f4b31d-12":  12,
+		`"5eb63bbbe01eeed093cb22bb8f5acdc3"`:   0,
+		"AAAAAA==-2":                           2,
+		"not-a-count":                          0,
+	}
+
+	for value, expected := range tests {
+		if count := multipartCount(value); count != expected {
+			t.Errorf("multipartCount(%#v): got %d; expected %d", value, count, expected)
+		}
+	}
+}
@@ -7,8 +7,11 @@ import (
 	"io"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/dacut/s3-tree-compare/internal/s3compare"
@@ -16,16 +19,48 @@ import (
 
 //go:generate ./generate-version
 
+// Exit statuses, as with diff(1).
+const (
+	exitIdentical = 0
+	exitDifferent = 1
+	exitTrouble   = 2
+)
+
 func main() {
 	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 
 	usage := func(w io.Writer) {
 		flags.SetOutput(w)
 		fmt.Fprintf(w, `Usage: %s [options] s3://bucket1/path1/ s3://bucket2/path2/
-Compare two S3 paths for differences by examining metadata (without downloading
-objects).
+Compare two S3 paths for differences by examining metadata. Objects are only
+downloaded with -compare-content or -multipart-etags.
+
+Either path may instead be a local directory, specified as file:///path/ or as
+a bare path. Local files are given the ETag S3 would assign to a single-part
+upload and a content type guessed from the file extension. With
+-local-file-metadata, they are also given x-amz-meta-file-* metadata for their
+permissions, owner, and group. Symlinks to directories are skipped.
 
 This calls HeadObject on each object found. Any differences found are noted.
+Errors that prevent objects from being compared are reported in the output
+as well.
+
+The exit status is 0 if the paths are identical, 1 if differences were found,
+and 2 if errors occurred. With -quiet, nothing is written; only the exit
+status is set.
+
+With -format=csv or -format=tsv, the output is a table with a row for each
+difference; with -format=html, it is a self-contained page with a collapsible
+tree of differences. These are written once the comparison finishes.
+
+With -summary, the output ends with a summary of the comparison: the number of
+prefixes and keys compared, keys found in only one location, mismatches (by
+header), errors, bytes compared, and calls made to each location. With
+-summary-file, the summary is written to a separate file as JSON.
+
+With -progress, the number of prefixes listed, keys compared, differences
+found, calls in-flight to each location, and the rate of calls are written to
+stderr every -progress-interval (on a single updating line on a terminal).
 
 Two objects are considered different if:
     - One object is missing.
@@ -38,14 +73,69 @@ Two objects are considered different if:
 		Content-Language
 		Content-Type
 		Expires
-		Website-Redirect-Location
+		x-amz-website-redirect-location
+		x-amz-storage-class
+		x-amz-server-side-encryption
+		x-amz-server-side-encryption-aws-kms-key-id
+		x-amz-object-lock-mode
+		x-amz-object-lock-retain-until-date
+		x-amz-object-lock-legal-hold
+		x-amz-replication-status
+		x-amz-checksum-* (with -compare-checksums)
 		x-amz-meta-* headers
+
+With -compare-checksums, full-object checksums (x-amz-checksum-*) are compared
+instead of the ETag when both objects have one using the same algorithm.
+
+With -multipart-etags, objects whose ETags differ because one was uploaded in
+multiple parts are checked for equivalence by reading the other object and
+recomputing its multipart ETag.
+
+With -compare-versions, the version history of each key (sizes, ETags, and
+delete markers) is compared as well, using ListObjectVersions.
+
+With -as-of1 and/or -as-of2, the corresponding location is compared as it was
+at that time, using ListObjectVersions to find the version of each key current
+at that time. Keys that were deleted (or not yet created) then are absent.
+
+With -flat, each location is listed without a delimiter and the two listings
+are merged as they are read, which takes far fewer requests for trees with many
+small directories.
+
+With -list-only, objects are first compared using the size, ETag, and storage
+class returned by the listing, and HeadObject is only called on objects whose
+listings differ (or for comparisons that need it, such as -compare-header).
+
+With -include and -exclude, only keys whose paths (relative to the paths being
+compared) match an -include pattern, and no -exclude pattern, are compared.
+Patterns are globs, in which ** matches across directories, unless prefixed
+with re: to give a regular expression. A pattern without a / matches the last
+component of a path at any depth; one ending in / matches only directories.
+Directories matching an -exclude pattern are not listed. For example:
+    -exclude '_temporary/' -exclude '*.crc' -exclude .DS_Store
+
+With -map-key (or rules read from -map-key-file, one per line), keys in the
+first location are renamed before looking for them in the second location,
+using sed-style substitutions on paths relative to the paths being compared.
+Directories are matched with a trailing /. For example:
+    -map-key 's/\.json$/.json.gz/' -map-key 's|^year=([0-9]+)/|$1/|'
+Rules that move keys into a different directory, or merge directories,
+require -flat; without it, the keys they move are reported as errors and
+compared unmapped. Keys mapped to the same key as another are also reported
+as errors and compared unmapped.
+Each listing of the first location is held in memory to be sorted by the
+mapped keys: each directory, or with -flat, every key under the first path.
+
+With -compare-content, both objects are also downloaded and a digest of their
+contents is compared. Content differences are reported separately; ETag
+differences alone are not reported in this mode.
 `, os.Args[0])
 
 		flags.PrintDefaults()
 	}
 
 	ignoredHeadersFlag := &StringListFlag{}
+	aclIDMapFlag := &StringListFlag{}
 
 	// Define flags for setting regions, profiles, endpoints. These are handled by getLoadOptions.
 	flags.String("endpoint", "", "S3 endpoint to use for both buckets.")
@@ -58,10 +148,60 @@ Two objects are considered different if:
 	flags.String("region1", "", "Override region for first S3 bucket.")
 	flags.String("region2", "", "Override region for second S3 bucket.")
 
+	asOf1Str := flags.String("as-of1", "",
+		"Compare the first location as it was at this time (RFC 3339 timestamp or YYYY-MM-DD).")
+	asOf2Str := flags.String("as-of2", "",
+		"Compare the second location as it was at this time (RFC 3339 timestamp or YYYY-MM-DD).")
 	concurrency := flags.Int("concurrency", 0, "Maximum concurrent S3 calls in-flight.")
+	retries := flags.Int("retries", s3compare.DefaultMaxRetries,
+		"Number of times to retry an S3 call that is throttled, fails with a server error, or loses its connection.")
+	retryDelay := flags.Duration("retry-delay", s3compare.DefaultRetryDelay,
+		"Base delay before retrying an S3 call; doubled (with random jitter) on each attempt.")
+	rps1 := flags.Float64("rps1", 0, "Maximum S3 calls per second to the first location (0 for no limit).")
+	rps2 := flags.Float64("rps2", 0, "Maximum S3 calls per second to the second location (0 for no limit).")
+	compareChecksums := flags.Bool("compare-checksums", false,
+		"Compare full-object checksums instead of ETags when both objects have one.")
+	compareContent := flags.Bool("compare-content", false, "Download objects and compare digests of their contents.")
+	compareACLs := flags.Bool("compare-acls", false, "Compare object owners and ACL grants (via GetObjectAcl).")
+	flags.Var(aclIDMapFlag, "map-acl-id",
+		"Treat a canonical user ID in ACLs from the first location as another ID (id1=id2). Can be repeated.")
+	compareTags := flags.Bool("compare-tags", false, "Compare object tags (via GetObjectTagging).")
+	compareVersions := flags.Bool("compare-versions", false,
+		"Compare the version history of each key (via ListObjectVersions).")
+	compareHeadersFlag := &StringListFlag{}
+	flags.Var(compareHeadersFlag, "compare-header",
+		"With -list-only, always call HeadObject to compare the specified header. Can be repeated.")
+	listOnly := flags.Bool("list-only", false,
+		"Compare sizes, ETags, and storage classes from listings, calling HeadObject only if they differ.")
+	shardChars := flags.String("shard-chars", "",
+		"Split listings that don't fit in one page at these characters and list the ranges in parallel.")
+	includeFlag := &StringListFlag{}
+	flags.Var(includeFlag, "include",
+		"Only compare keys matching this glob (or re:regex), relative to the paths compared. Can be repeated.")
+	excludeFlag := &StringListFlag{}
+	flags.Var(excludeFlag, "exclude",
+		"Skip keys and directories matching this glob (or re:regex), relative to the paths compared. Can be repeated.")
+	mapKeyFlag := &StringListFlag{}
+	flags.Var(mapKeyFlag, "map-key",
+		"Map keys in the first location to keys in the second with s/regex/replacement/. Holds each listing of the "+
+			"first location in memory. Can be repeated.")
+	mapKeyFile := flags.String("map-key-file", "", "Read -map-key rules from a file, one per line.")
+	localFileMetadata := flags.Bool("local-file-metadata", false,
+		"Report the permissions, owner, and group of local files as x-amz-meta-file-* metadata.")
+	flat := flags.Bool("flat", false,
+		"List each location without a delimiter and merge the listings, instead of listing each directory.")
+	multipartETags := flags.Bool("multipart-etags", false,
+		"Recompute multipart ETags to check whether differing ETags are equivalent.")
+	contentHash := flags.String("content-hash", s3compare.DefaultContentHash,
+		fmt.Sprintf("Hash algorithm used by -compare-content (%s).", strings.Join(s3compare.ContentHashNames(), "/")))
 	flags.Var(ignoredHeadersFlag, "ignore-header", "Add header to list of headers to ignore.")
-	outputFormatStr := flags.String("format", "text", "Output format (text/json; defaults to text).")
+	outputFormatStr := flags.String("format", "text", "Output format (text/json/ndjson/csv/tsv/html; defaults to text).")
 	outputFileFlag := flags.String("output", "", "Write output to specified file (defaults to stdout).")
+	quiet := flags.Bool("quiet", false, "Don't write any output; only set the exit status.")
+	printSummary := flags.Bool("summary", false, "Write a summary of the comparison at the end of the output.")
+	summaryFile := flags.String("summary-file", "", "Write a summary of the comparison to the specified file as JSON.")
+	progress := flags.Bool("progress", false, "Periodically write the progress of the comparison to stderr.")
+	progressInterval := flags.Duration("progress-interval", 2*time.Second, "Interval between -progress reports.")
 	versionFlag := flags.Bool("version", false, "Get the current version.")
 
 	help := flags.Bool("help", false, "Show this usage information.")
@@ -70,20 +210,21 @@ Two objects are considered different if:
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		usage(os.Stderr)
-		os.Exit(1)
+		os.Exit(exitTrouble)
 	}
 
 	if *help {
 		usage(os.Stdout)
-		os.Exit(0)
+		os.Exit(exitIdentical)
 	}
 
 	if *versionFlag {
 		fmt.Printf("%s\n", version)
-		os.Exit(0)
+		os.Exit(exitIdentical)
 	}
 
 	var output io.Writer
+	var outputFile *os.File
 	var outputFormat s3compare.OutputFormat
 
 	switch *outputFormatStr {
@@ -91,85 +232,105 @@ Two objects are considered different if:
 		outputFormat = s3compare.OutputFormatText
 	case "json":
 		outputFormat = s3compare.OutputFormatJSON
+	case "ndjson":
+		outputFormat = s3compare.OutputFormatNDJSON
+	case "csv":
+		outputFormat = s3compare.OutputFormatCSV
+	case "tsv":
+		outputFormat = s3compare.OutputFormatTSV
+	case "html":
+		outputFormat = s3compare.OutputFormatHTML
 	default:
-		fmt.Fprintf(os.Stderr, "Invalid value for -output-format: must be text or json: %#v\n", outputFormatStr)
+		fmt.Fprintf(os.Stderr, "Invalid value for -format: must be text, json, ndjson, csv, tsv, or html: %#v\n",
+			*outputFormatStr)
 		usage(os.Stderr)
-		os.Exit(1)
+		os.Exit(exitTrouble)
 	}
 
 	if *concurrency < 0 {
 		fmt.Fprintf(os.Stderr, "Invalid value for -concurrency: must be greater than 0: %d", *concurrency)
 		usage(os.Stderr)
-		os.Exit(1)
+		os.Exit(exitTrouble)
 	}
 
-	locations := flags.Args()
-	if len(locations) < 2 {
-		fmt.Fprintf(os.Stderr, "Expected two S3 locations to compare\n")
+	if *retries < 0 || *retryDelay < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -retries/-retry-delay: must not be negative\n")
 		usage(os.Stderr)
-		os.Exit(1)
+		os.Exit(exitTrouble)
 	}
 
-	bucket1, prefix1, err := parseS3URL(locations[0])
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid S3 URL: %v: %s\n", err, locations[0])
-		os.Exit(1)
+	if *progressInterval <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -progress-interval: must be greater than 0\n")
+		usage(os.Stderr)
+		os.Exit(exitTrouble)
 	}
 
-	bucket2, prefix2, err := parseS3URL(locations[1])
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid S3 URL: %v: %s\n", err, locations[1])
-		os.Exit(1)
+	if *rps1 < 0 || *rps2 < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -rps1/-rps2: must not be negative\n")
+		usage(os.Stderr)
+		os.Exit(exitTrouble)
 	}
 
-	loadOptions1, err := getLoadOptions(flags, []string{"", "1"})
+	locations := flags.Args()
+	if len(locations) < 2 {
+		fmt.Fprintf(os.Stderr, "Expected two locations to compare\n")
+		usage(os.Stderr)
+		os.Exit(exitTrouble)
+	}
+
+	location1, err := parseLocation(locations[0])
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "Invalid location: %v: %s\n", err, locations[0])
+		os.Exit(exitTrouble)
 	}
 
-	loadOptions2, err := getLoadOptions(flags, []string{"", "2"})
+	location2, err := parseLocation(locations[1])
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "Invalid location: %v: %s\n", err, locations[1])
+		os.Exit(exitTrouble)
 	}
 
 	// Cancel all work if we're interrupted.
 	ctx, _ := signal.NotifyContext(context.Background(), syscall.SIGPIPE, syscall.SIGINT, syscall.SIGTERM)
 
-	awsConfig1, err := config.LoadDefaultConfig(ctx, loadOptions1...)
+	backend1, err := newBackend(ctx, flags, location1, "1")
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to configure AWS client for %s: %v\n", locations[0], err)
-		os.Exit(1)
+		os.Exit(exitTrouble)
 	}
 
-	awsConfig2, err := config.LoadDefaultConfig(ctx, loadOptions2...)
+	backend2, err := newBackend(ctx, flags, location2, "2")
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to configure AWS client for %s: %v\n", locations[1], err)
-		os.Exit(1)
+		os.Exit(exitTrouble)
+	}
+
+	if *localFileMetadata {
+		for _, backend := range []s3compare.Backend{backend1, backend2} {
+			if localBackend, ok := backend.(*s3compare.LocalBackend); ok {
+				localBackend.EnableFileMetadata()
+			}
+		}
 	}
 
 	// Open up the output (if necessary)
-	switch *outputFileFlag {
-	case "", "-":
+	switch {
+	case *quiet:
+		output = io.Discard
+	case *outputFileFlag == "" || *outputFileFlag == "-":
 		output = os.Stdout
 	default:
-		var outputFile *os.File
 		outputFile, err = os.Create(*outputFileFlag)
 
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Unable to open %s for writing: %v\n", *outputFileFlag, err)
-			os.Exit(1)
+			os.Exit(exitTrouble)
 		}
-		defer outputFile.Close()
 		output = outputFile
 	}
 
-	s3Client1 := s3.NewFromConfig(awsConfig1)
-	s3Client2 := s3.NewFromConfig(awsConfig2)
-
 	// Create the comparer and set options
-	comparer := s3compare.NewS3Comparer(ctx, output, outputFormat, s3Client1, s3Client2, bucket1, bucket2)
+	comparer := s3compare.NewS3Comparer(ctx, output, outputFormat, backend1, backend2)
 
 	for _, ignoredHeader := range ignoredHeadersFlag.Values {
 		comparer.IgnoreHeader(ignoredHeader)
@@ -179,6 +340,195 @@ Two objects are considered different if:
 		comparer.Concurrency(uint(*concurrency))
 	}
 
+	comparer.Retries(*retries, *retryDelay)
+
+	if *rps1 > 0 {
+		comparer.RateLimit1(*rps1)
+	}
+
+	if *rps2 > 0 {
+		comparer.RateLimit2(*rps2)
+	}
+
+	if *compareChecksums {
+		comparer.CompareChecksums()
+	}
+
+	if *compareTags {
+		if err = comparer.CompareTags(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to compare tags: %v\n", err)
+			os.Exit(exitTrouble)
+		}
+	}
+
+	if *compareACLs {
+		if err = comparer.CompareACLs(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to compare ACLs: %v\n", err)
+			os.Exit(exitTrouble)
+		}
+	}
+
+	for _, mapping := range aclIDMapFlag.Values {
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			fmt.Fprintf(os.Stderr, "Invalid value for -map-acl-id: must be id1=id2: %#v\n", mapping)
+			os.Exit(exitTrouble)
+		}
+
+		comparer.MapACLID(parts[0], parts[1])
+	}
+
+	if *compareVersions {
+		if err = comparer.CompareVersions(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to compare versions: %v\n", err)
+			os.Exit(exitTrouble)
+		}
+	}
+
+	if *asOf1Str != "" {
+		asOf1, err := parseTimestamp(*asOf1Str)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid value for -as-of1: %v\n", err)
+			os.Exit(exitTrouble)
+		}
+
+		if err = comparer.AsOf1(asOf1); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to compare %s as of %s: %v\n", locations[0], *asOf1Str, err)
+			os.Exit(exitTrouble)
+		}
+	}
+
+	if *asOf2Str != "" {
+		asOf2, err := parseTimestamp(*asOf2Str)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid value for -as-of2: %v\n", err)
+			os.Exit(exitTrouble)
+		}
+
+		if err = comparer.AsOf2(asOf2); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to compare %s as of %s: %v\n", locations[1], *asOf2Str, err)
+			os.Exit(exitTrouble)
+		}
+	}
+
+	for _, pattern := range includeFlag.Values {
+		if err = comparer.Include(pattern); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid value for -include: %v\n", err)
+			os.Exit(exitTrouble)
+		}
+	}
+
+	for _, pattern := range excludeFlag.Values {
+		if err = comparer.Exclude(pattern); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid value for -exclude: %v\n", err)
+			os.Exit(exitTrouble)
+		}
+	}
+
+	mapKeyRules := mapKeyFlag.Values
+
+	if *mapKeyFile != "" {
+		fileRules, err := readKeyMapRules(*mapKeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read key mappings: %v\n", err)
+			os.Exit(exitTrouble)
+		}
+
+		mapKeyRules = append(mapKeyRules, fileRules...)
+	}
+
+	for _, rule := range mapKeyRules {
+		if err = comparer.MapKey(rule); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid value for -map-key: %v\n", err)
+			os.Exit(exitTrouble)
+		}
+	}
+
+	if *flat {
+		comparer.FlatListing()
+	}
+
+	if *shardChars != "" {
+		if err = comparer.ShardListings(*shardChars); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid value for -shard-chars: %v\n", err)
+			os.Exit(exitTrouble)
+		}
+	}
+
+	if *listOnly {
+		comparer.ListOnly()
+	}
+
+	for _, header := range compareHeadersFlag.Values {
+		comparer.CompareHeader(header)
+	}
+
+	if *multipartETags {
+		comparer.MultipartETags()
+	}
+
+	if *compareContent {
+		if err = comparer.CompareContent(*contentHash); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid value for -content-hash: %v\n", err)
+			os.Exit(exitTrouble)
+		}
+	}
+
+	if *printSummary {
+		comparer.PrintSummary()
+	}
+
+	if *progress {
+		comparer.ReportProgress(os.Stderr, *progressInterval, isTerminal(os.Stderr))
+	}
+
 	// Run the comparer
-	comparer.ComparePrefixes(prefix1, prefix2)
+	summary := comparer.ComparePrefixes(location1.prefix, location2.prefix)
+
+	if outputFile != nil {
+		outputFile.Close()
+	}
+
+	if *summaryFile != "" {
+		if err = writeSummaryFile(*summaryFile, &summary); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write summary to %s: %v\n", *summaryFile, err)
+			os.Exit(exitTrouble)
+		}
+	}
+
+	switch {
+	case summary.Errored > 0 || ctx.Err() != nil:
+		// Some keys or prefixes couldn't be compared; these have been reported as errors (unless we were interrupted).
+		os.Exit(exitTrouble)
+	case !summary.Identical():
+		os.Exit(exitDifferent)
+	default:
+		os.Exit(exitIdentical)
+	}
+}
+
+// newBackend returns the backend to use for the given location. S3 locations are configured using flags and
+// environment variables with the given suffix (in addition to the unsuffixed ones).
+func newBackend(ctx context.Context, flags *flag.FlagSet, loc location, suffix string) (s3compare.Backend, error) {
+	if loc.local {
+		return s3compare.NewLocalBackend(loc.bucket), nil
+	}
+
+	loadOptions, err := getLoadOptions(flags, []string{"", suffix})
+	if err != nil {
+		return nil, err
+	}
+
+	awsConfig, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Calls are retried by the comparer, which also adapts its concurrency to throttling. Retries made by the SDK would
+	// multiply the attempts made and hide throttling from it until they were exhausted.
+	client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		o.Retryer = aws.NopRetryer{}
+	})
+
+	return s3compare.NewS3Backend(client, loc.bucket), nil
 }
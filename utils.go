@@ -1,11 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/dacut/s3-tree-compare/internal/s3compare"
 )
 
 const s3URLPrefix = "s3://"
+const fileURLPrefix = "file://"
+
+// location is a parsed path to compare: either an S3 bucket and prefix, or a local root directory and prefix.
+type location struct {
+	local  bool
+	bucket string
+	prefix string
+}
 
 func parseS3URL(s3URLString string) (bucket string, key string, err error) {
 	if !strings.HasPrefix(s3URLString, s3URLPrefix) {
@@ -22,3 +38,124 @@ func parseS3URL(s3URLString string) (bucket string, key string, err error) {
 
 	return
 }
+
+// parseLocation parses an s3:// URL, a file:// URL, or a bare local path. File URLs must name a path on this host:
+// their host, if any, must be localhost.
+//
+// Local paths that name a directory (or end with a path separator) are compared from the root of that directory.
+// Otherwise, the last path element is used as a key prefix within the parent directory, mirroring S3 prefix semantics.
+func parseLocation(locationString string) (loc location, err error) {
+	if strings.HasPrefix(locationString, s3URLPrefix) {
+		loc.bucket, loc.prefix, err = parseS3URL(locationString)
+		return
+	}
+
+	path := locationString
+	if strings.HasPrefix(path, fileURLPrefix) {
+		if path, err = parseFileURL(path); err != nil {
+			return
+		}
+	}
+
+	if path == "" {
+		err = errors.New("local path must not be empty")
+		return
+	}
+
+	isDir := strings.HasSuffix(path, "/") || strings.HasSuffix(path, string(filepath.Separator))
+
+	if path, err = filepath.Abs(path); err != nil {
+		return
+	}
+
+	if fi, statErr := os.Stat(path); statErr == nil && fi.IsDir() {
+		isDir = true
+	}
+
+	loc.local = true
+
+	if isDir {
+		loc.bucket = path
+	} else {
+		loc.bucket = filepath.Dir(path)
+		loc.prefix = filepath.Base(path)
+	}
+
+	return
+}
+
+// parseFileURL returns the local path of a file:// URL, which is either file:///path or file://localhost/path.
+func parseFileURL(fileURLString string) (string, error) {
+	rest := strings.TrimPrefix(fileURLString, fileURLPrefix)
+
+	slash := strings.Index(rest, "/")
+	if slash < 0 {
+		return "", fmt.Errorf("file URL %#v has no path", fileURLString)
+	}
+
+	if host := rest[:slash]; host != "" && !strings.EqualFold(host, "localhost") {
+		return "", fmt.Errorf("file URL %#v names host %#v; only local paths are supported", fileURLString, host)
+	}
+
+	// On Windows, the path of file:///C:/dir is C:/dir.
+	path := rest[slash:]
+	if filepath.VolumeName(path[1:]) != "" {
+		path = path[1:]
+	}
+
+	return path, nil
+}
+
+// parseTimestamp parses an RFC 3339 timestamp, or a date (YYYY-MM-DD), which is taken as midnight UTC.
+func parseTimestamp(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+// readKeyMapRules reads key mapping rules from a file, one per line. Blank lines and lines beginning with "#" are
+// skipped.
+func readKeyMapRules(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rules = append(rules, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return rules, nil
+}
+
+// writeSummaryFile writes a comparison summary to a file as JSON.
+func writeSummaryFile(filename string, summary *s3compare.Summary) error {
+	data, err := json.MarshalIndent(summary, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filename, append(data, '\n'), 0o644) //nolint:gosec // Written like the -output file.
+}
+
+// isTerminal indicates whether a file is a terminal (or other character device).
+func isTerminal(file *os.File) bool {
+	fi, err := file.Stat()
+
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLocation(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "build"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// File URL paths begin with "/" on Windows too (file:///C:/dir).
+	slashDir := filepath.ToSlash(dir)
+	if !strings.HasPrefix(slashDir, "/") {
+		slashDir = "/" + slashDir
+	}
+
+	dirURL := fileURLPrefix + slashDir
+	build := filepath.Join(dir, "build")
+
+	tests := []struct {
+		location string
+		expected location
+	}{
+		{"s3://bucket/path/", location{bucket: "bucket", prefix: "path/"}},
+		{"s3://bucket", location{bucket: "bucket"}},
+		{build, location{local: true, bucket: build}},
+		{filepath.Join(dir, "build-"), location{local: true, bucket: dir, prefix: "build-"}},
+		{dirURL + "/build", location{local: true, bucket: build}},
+		{dirURL + "/missing/", location{local: true, bucket: filepath.Join(dir, "missing")}},
+		{"file://localhost" + slashDir + "/build-", location{local: true, bucket: dir, prefix: "build-"}},
+	}
+
+	for _, test := range tests {
+		loc, err := parseLocation(test.location)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.location, err)
+		} else if loc != test.expected {
+			t.Errorf("%s: expected %+v; got %+v", test.location, test.expected, loc)
+		}
+	}
+
+	// A path relative to the working directory.
+	if loc, err := parseLocation("build"); err != nil || !loc.local || !filepath.IsAbs(loc.bucket) {
+		t.Errorf("expected a relative path to be made absolute; got %+v, %v", loc, err)
+	}
+
+	for _, invalid := range []string{"", "file://", "file://host" + slashDir + "/build/", "file://host"} {
+		if loc, err := parseLocation(invalid); err == nil {
+			t.Errorf("%#v: expected an error; got %+v", invalid, loc)
+		}
+	}
+}